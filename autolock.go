@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// loadUnlockKey reads the persisted unlock key, if any, and the one it
+// replaced when it was last rotated.
+func (r *Reconcile) loadUnlockKey() {
+	if r.secrets == nil || r.unlockKeySecret == "" {
+		return
+	}
+	key, created, err := r.secrets.getSecret(r.unlockKeySecret)
+	if err != nil {
+		log.WithField("error", err.Error()).Warn("Failed to read unlock key")
+		return
+	}
+	r.storedUnlockKey = key
+	r.storedUnlockKeyCreated = created
+
+	previous, _, err := r.secrets.getSecret(r.unlockKeySecret + "-previous")
+	if err != nil {
+		log.WithField("error", err.Error()).Warn("Failed to read previous unlock key")
+		return
+	}
+	r.previousUnlockKey = previous
+}
+
+// currentUnlockKey prefers an explicitly configured key over the persisted one.
+func (r *Reconcile) currentUnlockKey() string {
+	if r.unlockKey != "" {
+		return r.unlockKey
+	}
+	return r.storedUnlockKey
+}
+
+// unlock unlocks a manager with the current key, or with the previous one if
+// the manager was down while the key was rotated.
+func (r *Reconcile) unlock(id string) error {
+	keys := []string{r.currentUnlockKey()}
+	if r.previousUnlockKey != "" && r.previousUnlockKey != keys[0] {
+		keys = append(keys, r.previousUnlockKey)
+	}
+
+	var err error
+	for i, key := range keys {
+		ctx, cancel := r.callContext(r.joinTimeout)
+		err = r.hostClient[id].SwarmUnlock(ctx, swarm.UnlockRequest{UnlockKey: key})
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if i < len(keys)-1 {
+			log.WithFields(log.Fields{
+				"id":     id,
+				"reason": err.Error(),
+			}).Info("Failed to unlock manager, retrying with the previous unlock key")
+		}
+	}
+	return err
+}
+
+// planAutolock enables autolock on an existing swarm, keeps the persisted
+// unlock key current and rotates it once it is older than unlockKeyRotation.
+func (r *Reconcile) planAutolock() {
+	if !r.autolock {
+		return
+	}
+
+	// SwarmInit enables autolock, so only the key needs to be stored
+	if r.plan.Decision == "new" {
+		r.plan.add(Step{Action: StepStoreUnlockKey})
+		return
+	}
+
+	m := r.managerClient()
+	if m == nil {
+		return
+	}
+
+	ctx, cancel := r.callContext(r.infoTimeout)
+	defer cancel()
+	s, err := m.SwarmInspect(ctx)
+	if err != nil {
+		log.WithField("error", err.Error()).Warn("Failed to inspect swarm")
+		return
+	}
+
+	var step Step
+	if !s.Spec.EncryptionConfig.AutoLockManagers {
+		step = Step{Action: StepEnableAutolock}
+	} else {
+		resp, err := m.SwarmGetUnlockKey(ctx)
+		if err != nil {
+			log.WithField("error", err.Error()).Warn("Failed to get unlock key")
+			return
+		}
+
+		switch {
+		case resp.UnlockKey != r.storedUnlockKey:
+			step = Step{Action: StepStoreUnlockKey}
+		case r.unlockKeyRotation > 0 && time.Since(r.storedUnlockKeyCreated) >= r.unlockKeyRotation:
+			step = Step{Action: StepRotateUnlockKey}
+		default:
+			return
+		}
+	}
+
+	if r.plan.Decision == "" {
+		r.plan.Decision = "autolock"
+	}
+	r.plan.add(step)
+}
+
+func (r *Reconcile) enableAutolock() error {
+	m := r.managerClient()
+	if m == nil {
+		return errNoManager
+	}
+	ctx, cancel := r.callContext(r.updateTimeout)
+	defer cancel()
+	s, err := m.SwarmInspect(ctx)
+	if err != nil {
+		return err
+	}
+	spec := s.Spec
+	spec.EncryptionConfig.AutoLockManagers = true
+	if err := m.SwarmUpdate(ctx, s.Version, spec, swarm.UpdateFlags{}); err != nil {
+		return err
+	}
+	return r.storeUnlockKey()
+}
+
+// rotateUnlockKey rotates the unlock key of the swarm. The key in use is first
+// copied to the unlockKeySecret-previous secret, which also proves the secret
+// store can be written, so that it's kept even if storing the new key fails.
+// A failed store is retried by the next reconciliation.
+func (r *Reconcile) rotateUnlockKey() error {
+	m := r.managerClient()
+	if m == nil {
+		return errNoManager
+	}
+	if r.secrets == nil || r.unlockKeySecret == "" {
+		return errors.New("no secret configured to store the rotated unlock key")
+	}
+	if err := r.secrets.putSecret(r.unlockKeySecret+"-previous", r.storedUnlockKey); err != nil {
+		return err
+	}
+	ctx, cancel := r.callContext(r.updateTimeout)
+	defer cancel()
+	s, err := m.SwarmInspect(ctx)
+	if err != nil {
+		return err
+	}
+	flags := swarm.UpdateFlags{
+		RotateManagerUnlockKey: true,
+	}
+	if err := m.SwarmUpdate(ctx, s.Version, s.Spec, flags); err != nil {
+		return err
+	}
+	return r.storeUnlockKey()
+}
+
+func (r *Reconcile) storeUnlockKey() error {
+	m := r.managerClient()
+	if m == nil {
+		return errNoManager
+	}
+	ctx, cancel := r.callContext(r.infoTimeout)
+	defer cancel()
+	resp, err := m.SwarmGetUnlockKey(ctx)
+	if err != nil {
+		return err
+	}
+	if r.secrets == nil || r.unlockKeySecret == "" {
+		log.Warn("No secret configured, the unlock key was not persisted")
+		return nil
+	}
+	if err := r.secrets.putSecret(r.unlockKeySecret, resp.UnlockKey); err != nil {
+		return err
+	}
+	r.storedUnlockKey = resp.UnlockKey
+	r.storedUnlockKeyCreated = time.Now()
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func TestAutolock(t *testing.T) {
+	const secret = "unlock-key"
+
+	tests := []struct {
+		name      string
+		hosts     []string
+		autolock  bool
+		stored    string
+		storedAge time.Duration
+		rotation  time.Duration
+		calls     map[string]int
+		wantKey   string
+	}{
+		{
+			name:    "new swarm",
+			hosts:   []string{"inactive", "inactive", "inactive"},
+			calls:   map[string]int{"init": 1, "swarm-update": 0, "put-secret": 1},
+			wantKey: fakeUnlockKey,
+		},
+		{
+			name:    "enable on existing swarm",
+			hosts:   []string{"manager", "manager", "manager"},
+			calls:   map[string]int{"swarm-update autolock=true rotate=false": 1, "put-secret": 1},
+			wantKey: fakeUnlockKey,
+		},
+		{
+			name:     "store missing key",
+			hosts:    []string{"manager", "manager", "manager"},
+			autolock: true,
+			calls:    map[string]int{"swarm-update": 0, "put-secret": 1},
+			wantKey:  fakeUnlockKey,
+		},
+		{
+			name:     "replace stale key",
+			hosts:    []string{"manager", "manager", "manager"},
+			autolock: true,
+			stored:   "SWMKEY-old",
+			calls:    map[string]int{"swarm-update": 0, "put-secret": 1},
+			wantKey:  fakeUnlockKey,
+		},
+		{
+			name:      "rotate old key",
+			hosts:     []string{"manager", "manager", "manager"},
+			autolock:  true,
+			stored:    fakeUnlockKey,
+			storedAge: 2 * time.Hour,
+			rotation:  time.Hour,
+			calls: map[string]int{
+				"swarm-update autolock=true rotate=true": 1,
+				"put-secret unlock-key-previous":         1,
+				"put-secret":                             2,
+			},
+			wantKey: "SWMKEY-1",
+		},
+		{
+			name:      "current key",
+			hosts:     []string{"manager", "manager", "manager"},
+			autolock:  true,
+			stored:    fakeUnlockKey,
+			storedAge: time.Minute,
+			rotation:  time.Hour,
+			calls:     map[string]int{"swarm-update": 0, "put-secret": 0},
+			wantKey:   fakeUnlockKey,
+		},
+		{
+			name:     "unlock with stored key",
+			hosts:    []string{"manager", "manager", "locked"},
+			autolock: true,
+			stored:   fakeUnlockKey,
+			calls:    map[string]int{"unlock 1h3": 1, "put-secret": 0},
+			wantKey:  fakeUnlockKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCluster(tt.hosts, nil)
+			c.autolock = tt.autolock
+			if tt.stored != "" {
+				c.secrets[secret] = fakeSecret{value: tt.stored, created: time.Now().Add(-tt.storedAge)}
+			}
+
+			opts := reconcileOptions{
+				managerCount:      3,
+				autolock:          true,
+				unlockKeySecret:   secret,
+				unlockKeyRotation: tt.rotation,
+				secrets:           c,
+			}
+			if err := newReconciliation(c, c, opts).run(context.Background()); err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			for prefix, want := range tt.calls {
+				if got := c.count(prefix); got != want {
+					t.Errorf("%q calls = %d, want %d (calls: %v)", prefix, got, want, c.calls)
+				}
+			}
+			if got := c.secrets[secret].value; got != tt.wantKey {
+				t.Errorf("stored key = %q, want %q", got, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestUnlockKeyRotationFailure(t *testing.T) {
+	const secret = "unlock-key"
+	c := newTestCluster([]string{"manager", "manager", "manager"}, nil)
+	c.autolock = true
+	c.secrets[secret] = fakeSecret{value: fakeUnlockKey, created: time.Now().Add(-2 * time.Hour)}
+	opts := reconcileOptions{
+		managerCount:      3,
+		autolock:          true,
+		unlockKeySecret:   secret,
+		unlockKeyRotation: time.Hour,
+		secrets:           c,
+	}
+	reconcile := func() error {
+		c.calls = nil
+		return newReconciliation(c, c, opts).run(context.Background())
+	}
+
+	// the key isn't rotated if the previous one can't be kept
+	c.failSecrets[secret+"-previous"] = true
+	if err := reconcile(); err == nil {
+		t.Fatal("run succeeded without keeping the previous key")
+	}
+	if got := c.count("swarm-update"); got != 0 {
+		t.Errorf("rotated the key without keeping the previous one (calls: %v)", c.calls)
+	}
+	delete(c.failSecrets, secret+"-previous")
+
+	// the new key can't be stored: both secrets keep the key in use before
+	c.failSecrets[secret] = true
+	if err := reconcile(); err == nil {
+		t.Fatal("run succeeded without storing the new key")
+	}
+	if c.unlockKey != "SWMKEY-1" {
+		t.Fatalf("swarm key = %q, want it rotated", c.unlockKey)
+	}
+	if got := c.secrets[secret].value; got != fakeUnlockKey {
+		t.Errorf("stored key = %q, want %q", got, fakeUnlockKey)
+	}
+	if got := c.secrets[secret+"-previous"].value; got != fakeUnlockKey {
+		t.Errorf("previous key = %q, want %q", got, fakeUnlockKey)
+	}
+
+	// the next reconciliation stores the new key
+	delete(c.failSecrets, secret)
+	if err := reconcile(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := c.secrets[secret].value; got != "SWMKEY-1" {
+		t.Errorf("stored key = %q, want SWMKEY-1", got)
+	}
+	if got := c.count("swarm-update"); got != 0 {
+		t.Errorf("rotated the key again (calls: %v)", c.calls)
+	}
+}
+
+func TestUnlockWithPreviousKey(t *testing.T) {
+	const secret = "unlock-key"
+	c := newTestCluster([]string{"manager", "manager", "locked"}, nil)
+	c.autolock = true
+	c.unlockKey = "SWMKEY-1"
+	c.secrets[secret] = fakeSecret{value: "SWMKEY-1", created: time.Now()}
+	c.secrets[secret+"-previous"] = fakeSecret{value: fakeUnlockKey, created: time.Now()}
+	// the manager was down while the key was rotated
+	c.daemons["1h3"].lockKey = fakeUnlockKey
+
+	opts := reconcileOptions{
+		managerCount:    3,
+		autolock:        true,
+		unlockKeySecret: secret,
+		secrets:         c,
+	}
+	if err := newReconciliation(c, c, opts).run(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := c.count("unlock 1h3"); got != 1 {
+		t.Errorf("unlock calls = %d, want 1 (calls: %v)", got, c.calls)
+	}
+	if got := c.daemons["1h3"].state; got != swarm.LocalNodeStateActive {
+		t.Errorf("manager state = %s, want active", got)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types/swarm"
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+// nodeLabelAvailability records the availability the orchestrator set on a
+// node, so that only its own drains and pauses are undone, never those made
+// with docker node update.
+const nodeLabelAvailability = "io.rancher.swarmkit.availability"
+
+// hostAvailability is the node availability a host's Rancher state asks for:
+// deactivated hosts drain, hosts with the pause label pause and every other
+// host is active.
+func (r *Reconcile) hostAvailability(h rancher.Host) swarm.NodeAvailability {
+	switch h.State {
+	case "inactive", "deactivating":
+		return swarm.NodeAvailabilityDrain
+	}
+	if _, ok := h.Labels[r.pauseLabel]; ok && r.pauseLabel != "" {
+		return swarm.NodeAvailabilityPause
+	}
+	return swarm.NodeAvailabilityActive
+}
+
+// planAvailability drains and pauses the nodes of deactivated and paused
+// hosts, and makes the nodes it drained or paused active again once their host
+// is back. A manager is only drained while the managers that stay available
+// keep a majority.
+func (r *Reconcile) planAvailability() {
+	managers, available := 0, 0
+	for _, n := range r.nodes {
+		if n.ManagerStatus == nil {
+			continue
+		}
+		managers++
+		if n.ManagerStatus.Reachability == swarm.ReachabilityReachable && n.Spec.Availability != swarm.NodeAvailabilityDrain {
+			available++
+		}
+	}
+
+	var steps []Step
+	for _, h := range r.registeredHosts {
+		n, ok := r.hostNodes.node(h.Id)
+		if !ok || n.Status.State == swarm.NodeStateDown {
+			continue
+		}
+		want := r.hostAvailability(h)
+		set, ours := n.Spec.Labels[nodeLabelAvailability]
+		step := Step{Action: StepSetAvailability, HostID: h.Id, NodeID: n.ID, Availability: want}
+		switch {
+		case want == swarm.NodeAvailabilityActive && !ours:
+			// the operator's own change, or nothing to undo
+			continue
+		case want == swarm.NodeAvailabilityActive:
+			step.RemoveLabels = []string{nodeLabelAvailability}
+		case want == n.Spec.Availability && (!ours || set == string(want)):
+			continue
+		default:
+			step.Labels = map[string]string{nodeLabelAvailability: string(want)}
+		}
+		if want == swarm.NodeAvailabilityDrain && n.Spec.Availability != want && n.ManagerStatus != nil {
+			if available-1 <= managers/2 {
+				log.WithFields(log.Fields{
+					"id":        h.Id,
+					"managers":  managers,
+					"available": available,
+				}).Warn("Not draining manager: this would leave no majority of available managers")
+				continue
+			}
+			available--
+		}
+		steps = append(steps, step)
+	}
+
+	if len(steps) == 0 {
+		return
+	}
+	if r.plan.Decision == "" {
+		r.plan.Decision = "sync-availability"
+	}
+	for _, step := range steps {
+		r.plan.add(step)
+	}
+}
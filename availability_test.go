@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func TestAvailability(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts []string
+		setup func(c *fakeCluster)
+		calls map[string]int
+		// marker is the availability node4 is marked with in the end
+		marker string
+	}{
+		{
+			name:  "drain deactivated worker",
+			hosts: []string{"manager", "manager", "manager", "worker"},
+			setup: func(c *fakeCluster) {
+				c.hosts[3].State = "inactive"
+			},
+			calls:  map[string]int{"update node4 role=worker availability=drain": 1},
+			marker: "drain",
+		},
+		{
+			name:  "reactivate host",
+			hosts: []string{"manager", "manager", "manager", "worker"},
+			setup: func(c *fakeCluster) {
+				c.hosts[3].State = "active"
+				n := c.node("node4")
+				n.Spec.Availability = swarm.NodeAvailabilityDrain
+				n.Spec.Labels[nodeLabelAvailability] = "drain"
+			},
+			calls: map[string]int{"update node4 role=worker availability=active": 1},
+		},
+		{
+			name:  "keep the operator's drain",
+			hosts: []string{"manager", "manager", "manager", "worker"},
+			setup: func(c *fakeCluster) {
+				c.node("node4").Spec.Availability = swarm.NodeAvailabilityDrain
+			},
+			calls: map[string]int{"update": 0},
+		},
+		{
+			name:  "deactivate a host the operator drained",
+			hosts: []string{"manager", "manager", "manager", "worker"},
+			setup: func(c *fakeCluster) {
+				c.hosts[3].State = "inactive"
+				c.node("node4").Spec.Availability = swarm.NodeAvailabilityDrain
+			},
+			calls: map[string]int{"update": 0},
+		},
+		{
+			name:  "pause labeled host",
+			hosts: []string{"manager", "manager", "manager", "worker"},
+			setup: func(c *fakeCluster) {
+				c.hosts[3].Labels["io.rancher.swarmkit.pause"] = "true"
+			},
+			calls:  map[string]int{"update node4 role=worker availability=pause": 1},
+			marker: "pause",
+		},
+		{
+			name:  "drain manager",
+			hosts: []string{"manager", "manager", "manager"},
+			setup: func(c *fakeCluster) {
+				c.hosts[0].State = "deactivating"
+			},
+			calls: map[string]int{"update node1 role=manager availability=drain": 1},
+		},
+		{
+			name:  "keep a majority of managers available",
+			hosts: []string{"manager", "manager", "manager"},
+			setup: func(c *fakeCluster) {
+				c.hosts[0].State = "inactive"
+				c.hosts[1].State = "inactive"
+			},
+			calls: map[string]int{"update": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCluster(tt.hosts, nil)
+			tt.setup(c)
+
+			opts := reconcileOptions{managerCount: 3, pauseLabel: "io.rancher.swarmkit.pause"}
+			if err := newReconciliation(c, c, opts).run(context.Background()); err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			for prefix, want := range tt.calls {
+				if got := c.count(prefix); got != want {
+					t.Errorf("%q calls = %d, want %d (calls: %v)", prefix, got, want, c.calls)
+				}
+			}
+			if n := c.node("node4"); n != nil && n.Spec.Labels[nodeLabelAvailability] != tt.marker {
+				t.Errorf("node4 marked %q, want %q", n.Spec.Labels[nodeLabelAvailability], tt.marker)
+			}
+		})
+	}
+}
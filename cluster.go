@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+const (
+	// foreign cluster policies
+	foreignClusterHold   = "hold"
+	foreignClusterRejoin = "rejoin"
+
+	// localNodeStateForeign buckets hosts that belong to a swarm other than
+	// the expected one.
+	localNodeStateForeign swarm.LocalNodeState = "foreign"
+)
+
+func infoClusterID(info types.Info) string {
+	if info.Swarm.Cluster == nil {
+		return ""
+	}
+	return info.Swarm.Cluster.ID
+}
+
+// resolveCluster determines which swarm is managed, preferring the pinned ID,
+// then the persisted one, then the only swarm seen on any host. Hosts that
+// belong to any other swarm are moved to the foreign state.
+func (r *Reconcile) resolveCluster() error {
+	seen := make(map[string]bool)
+	for _, info := range r.hostInfo {
+		if id := infoClusterID(info); id != "" {
+			seen[id] = true
+		}
+	}
+
+	var stored string
+	if r.metadata != nil {
+		var err error
+		if stored, err = r.metadata.getMetadata(metadataClusterID); err != nil {
+			log.WithField("error", err.Error()).Warn("Failed to read cluster ID")
+		}
+	}
+
+	expected := r.clusterID
+	if expected == "" {
+		expected = stored
+	}
+
+	if expected == "" {
+		switch len(seen) {
+		case 0:
+			return nil
+		case 1:
+			for id := range seen {
+				expected = id
+			}
+		default:
+			var ids []string
+			for id := range seen {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			return fmt.Errorf("Multiple cluster IDs detected (%s). Pin the expected cluster with --cluster-id.", strings.Join(ids, ", "))
+		}
+	}
+	r.expectedCluster = expected
+
+	// a running swarm that wasn't recorded yet is adopted
+	r.adopting = seen[expected] && (expected != stored || r.adoptOnly)
+
+	foreign := func(h rancher.Host) bool {
+		id := infoClusterID(r.hostInfo[h.Id])
+		return id != "" && id != expected
+	}
+	filter := func(hosts []rancher.Host) []rancher.Host {
+		var keep []rancher.Host
+		for _, h := range hosts {
+			if !foreign(h) {
+				keep = append(keep, h)
+			}
+		}
+		return keep
+	}
+
+	var foreignHosts []rancher.Host
+	for state, hosts := range r.nodeState {
+		for _, h := range hosts {
+			if foreign(h) {
+				foreignHosts = append(foreignHosts, h)
+			}
+		}
+		r.nodeState[state] = filter(hosts)
+	}
+	r.nodeState[localNodeStateForeign] = foreignHosts
+	r.managerHosts = filter(r.managerHosts)
+	r.workerHosts = filter(r.workerHosts)
+
+	return nil
+}
+
+// planForeignHosts applies the foreign cluster policy.
+func (r *Reconcile) planForeignHosts() {
+	for _, h := range r.nodeState[localNodeStateForeign] {
+		f := log.Fields{
+			"id":       h.Id,
+			"cluster":  infoClusterID(r.hostInfo[h.Id]),
+			"expected": r.expectedCluster,
+			"policy":   r.foreignClusterPolicy,
+		}
+		if r.foreignClusterPolicy != foreignClusterRejoin {
+			log.WithFields(f).Warn("Host belongs to a foreign swarm")
+			continue
+		}
+		log.WithFields(f).Info("Host belongs to a foreign swarm and will rejoin")
+		r.plan.add(Step{Action: StepLeave, HostID: h.Id, Address: h.AgentIpAddress, Force: true})
+	}
+}
+
+// planAdoption records the ID and join tokens of an adopted swarm and labels
+// its managers, after which it is reconciled like any other.
+func (r *Reconcile) planAdoption() {
+	if !r.adopting {
+		return
+	}
+
+	var steps []Step
+	if r.metadata != nil {
+		steps = append(steps, Step{Action: StepPinCluster, ClusterID: r.expectedCluster})
+	}
+	if r.secrets != nil && r.joinTokenSecret != "" && !r.joinTokensRecorded() {
+		steps = append(steps, Step{Action: StepRecordJoinTokens, ClusterID: r.expectedCluster})
+	}
+	for _, h := range r.managerHosts {
+		if _, ok := h.Labels["manager"]; !ok {
+			steps = append(steps, Step{Action: StepLabelManager, HostID: h.Id, Address: h.AgentIpAddress})
+		}
+	}
+
+	if len(steps) == 0 {
+		return
+	}
+	if r.plan.Decision == "" {
+		r.plan.Decision = "adopt"
+	}
+	for _, step := range steps {
+		r.plan.add(step)
+	}
+}
+
+// recordCluster persists the ID and join tokens of the swarm initialized on
+// the manager.
+func (r *Reconcile) recordCluster(m swarmDaemon) error {
+	ctx, cancel := r.callContext(r.infoTimeout)
+	s, err := m.SwarmInspect(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	r.expectedCluster = s.ID
+	r.joinTokens = s.JoinTokens
+	if err := r.pinClusterID(s.ID); err != nil {
+		return err
+	}
+	return r.recordJoinTokens()
+}
+
+func (r *Reconcile) pinClusterID(id string) error {
+	if r.metadata == nil {
+		log.WithField("cluster", id).Warn("No metadata store, the cluster ID was not persisted")
+		return nil
+	}
+	return r.metadata.putMetadata(metadataClusterID, id)
+}
+
+// joinTokensRecorded reports whether the secrets already hold the swarm's join
+// tokens. Without a metadata store to pin it, the swarm is adopted again on
+// every reconciliation, and the tokens would otherwise be rewritten each time.
+func (r *Reconcile) joinTokensRecorded() bool {
+	if r.joinTokens.Manager == "" || r.joinTokens.Worker == "" {
+		r.getJoinTokens()
+	}
+	if r.joinTokens.Manager == "" || r.joinTokens.Worker == "" {
+		return false
+	}
+	for suffix, token := range map[string]string{
+		"-manager": r.joinTokens.Manager,
+		"-worker":  r.joinTokens.Worker,
+	} {
+		stored, _, err := r.secrets.getSecret(r.joinTokenSecret + suffix)
+		if err != nil {
+			log.WithField("error", err.Error()).Warn("Failed to read join token")
+			return false
+		}
+		if stored != token {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Reconcile) recordJoinTokens() error {
+	if r.joinTokens.Manager == "" || r.joinTokens.Worker == "" {
+		r.getJoinTokens()
+	}
+	if r.joinTokens.Manager == "" || r.joinTokens.Worker == "" {
+		return errNoManager
+	}
+	// the manager token controls the whole swarm, so the tokens are kept in
+	// secrets rather than in metadata every container can read
+	if r.secrets == nil || r.joinTokenSecret == "" {
+		log.Warn("No secret configured, the join tokens were not persisted")
+		return nil
+	}
+	if err := r.secrets.putSecret(r.joinTokenSecret+"-manager", r.joinTokens.Manager); err != nil {
+		return err
+	}
+	return r.secrets.putSecret(r.joinTokenSecret+"-worker", r.joinTokens.Worker)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestClusterIdentity(t *testing.T) {
+	tests := []struct {
+		name      string
+		hosts     []string
+		clusterID string
+		stored    string
+		policy    string
+		metadata  bool
+		wantErr   string
+		calls     map[string]int
+	}{
+		{
+			name:    "split brain without a pinned cluster",
+			hosts:   []string{"manager", "worker", "foreign"},
+			wantErr: "Multiple cluster IDs detected (cluster-1, cluster-2)",
+		},
+		{
+			name:      "hold foreign host",
+			hosts:     []string{"foreign", "manager", "manager", "manager"},
+			clusterID: "cluster-1",
+			policy:    foreignClusterHold,
+			calls:     map[string]int{"leave": 0, "update": 0},
+		},
+		{
+			name:      "foreign host rejoins",
+			hosts:     []string{"foreign", "manager", "manager", "manager"},
+			clusterID: "cluster-1",
+			policy:    foreignClusterRejoin,
+			calls:     map[string]int{"leave 1h1 force=true": 1},
+		},
+		{
+			name:     "expected cluster read from metadata",
+			hosts:    []string{"manager", "manager", "manager", "foreign"},
+			stored:   "cluster-1",
+			policy:   foreignClusterRejoin,
+			metadata: true,
+			calls:    map[string]int{"leave 1h4 force=true": 1, "put-metadata": 0},
+		},
+		{
+			name:     "pin discovered cluster",
+			hosts:    []string{"manager", "manager", "manager"},
+			metadata: true,
+			calls:    map[string]int{"put-metadata swarm-cluster-id=cluster-1": 1},
+		},
+		{
+			name:     "pin new cluster",
+			hosts:    []string{"inactive", "inactive", "inactive"},
+			metadata: true,
+			calls:    map[string]int{"init": 1, "put-metadata swarm-cluster-id=cluster-1": 1},
+		},
+		{
+			name:      "no init while foreign hosts are held",
+			hosts:     []string{"inactive", "inactive", "foreign"},
+			clusterID: "cluster-1",
+			policy:    foreignClusterHold,
+			calls:     map[string]int{"init": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCluster(tt.hosts, nil)
+			opts := reconcileOptions{
+				managerCount:         3,
+				clusterID:            tt.clusterID,
+				foreignClusterPolicy: tt.policy,
+			}
+			if tt.metadata {
+				opts.metadata = c
+				if tt.stored != "" {
+					c.metadata[metadataClusterID] = tt.stored
+				}
+			}
+
+			err := newReconciliation(c, c, opts).run(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				if len(c.calls) > 0 {
+					t.Errorf("unexpected calls: %v", c.calls)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			for prefix, want := range tt.calls {
+				if got := c.count(prefix); got != want {
+					t.Errorf("%q calls = %d, want %d (calls: %v)", prefix, got, want, c.calls)
+				}
+			}
+		})
+	}
+}
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   []string
+		wantErr string
+		calls   map[string]int
+	}{
+		{
+			name:  "adopt existing swarm",
+			hosts: []string{"manager", "manager", "worker", "inactive"},
+			calls: map[string]int{
+				"put-metadata swarm-cluster-id=cluster-1": 1,
+				"put-metadata swarm-":                     1,
+				"put-secret swarmkit-join-token-manager":  1,
+				"put-secret swarmkit-join-token-worker":   1,
+				"join":                                    0,
+				"update":                                  0,
+			},
+		},
+		{
+			name:    "no swarm to import",
+			hosts:   []string{"inactive", "inactive"},
+			wantErr: "No swarm found to import",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCluster(tt.hosts, nil)
+			// managers of an unmanaged swarm carry no label yet
+			for _, h := range c.hosts {
+				delete(h.Labels, "manager")
+			}
+			opts := reconcileOptions{
+				managerCount:         3,
+				foreignClusterPolicy: foreignClusterHold,
+				metadata:             c,
+				secrets:              c,
+				joinTokenSecret:      "swarmkit-join-token",
+				adoptOnly:            true,
+			}
+
+			err := newReconciliation(c, c, opts).run(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			for prefix, want := range tt.calls {
+				if got := c.count(prefix); got != want {
+					t.Errorf("%q calls = %d, want %d (calls: %v)", prefix, got, want, c.calls)
+				}
+			}
+			if got := c.labeled("manager"); got != 2 {
+				t.Errorf("manager labels = %d, want 2", got)
+			}
+		})
+	}
+}
+
+func TestAdoptionWithoutMetadata(t *testing.T) {
+	c := newTestCluster([]string{"manager", "manager", "worker"}, nil)
+	opts := reconcileOptions{
+		managerCount:    3,
+		secrets:         c,
+		joinTokenSecret: "swarmkit-join-token",
+	}
+
+	// the swarm can't be pinned, so every reconciliation adopts it again
+	for i, want := range []int{2, 0} {
+		c.calls = nil
+		if err := newReconciliation(c, c, opts).run(context.Background()); err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+		if got := c.count("put-secret"); got != want {
+			t.Errorf("run %d: put-secret calls = %d, want %d (calls: %v)", i+1, got, want, c.calls)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	rancher "github.com/rancher/go-rancher/v2"
+	dockerapiproxy "github.com/rancher/rancher-docker-api-proxy"
+)
+
+const (
+	// transportTCP connects directly to the daemon on the host's agent IP.
+	transportTCP = "tcp"
+	// transportHostAccess tunnels the Docker API through a Rancher host
+	// access websocket, requiring only Rancher API credentials.
+	transportHostAccess = "hostaccess"
+
+	dockerPort    = 2375
+	dockerTLSPort = 2376
+
+	// verify the daemon certificate against the agent IP or the hostname
+	serverNameIP       = "ip"
+	serverNameHostname = "hostname"
+
+	// host labels naming Rancher secrets that hold per-host PEM material
+	labelTLSCA   = "io.rancher.swarmkit.tls.ca"
+	labelTLSCert = "io.rancher.swarmkit.tls.cert"
+	labelTLSKey  = "io.rancher.swarmkit.tls.key"
+)
+
+// swarmDaemon is the subset of the Docker API used to manage a host's swarm
+// membership. It is satisfied by *client.Client.
+type swarmDaemon interface {
+	Info(ctx context.Context) (types.Info, error)
+	SwarmInit(ctx context.Context, req swarm.InitRequest) (string, error)
+	SwarmJoin(ctx context.Context, req swarm.JoinRequest) error
+	SwarmInspect(ctx context.Context) (swarm.Swarm, error)
+	SwarmLeave(ctx context.Context, force bool) error
+	SwarmUnlock(ctx context.Context, req swarm.UnlockRequest) error
+	SwarmUpdate(ctx context.Context, version swarm.Version, spec swarm.Spec, flags swarm.UpdateFlags) error
+	SwarmGetUnlockKey(ctx context.Context) (types.SwarmUnlockKeyResponse, error)
+	NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error)
+	NodeInspectWithRaw(ctx context.Context, nodeID string) (swarm.Node, []byte, error)
+	NodeUpdate(ctx context.Context, nodeID string, version swarm.Version, node swarm.NodeSpec) error
+	NodeRemove(ctx context.Context, nodeID string, options types.NodeRemoveOptions) error
+	TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error)
+	NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	Ping(ctx context.Context) (types.Ping, error)
+	Close() error
+}
+
+// daemonDialer opens a connection to the Docker daemon of a Rancher host.
+type daemonDialer interface {
+	connect(ctx context.Context, h rancher.Host) (swarmDaemon, error)
+}
+
+type daemonTLS struct {
+	ca, cert, key []byte
+	hostSecrets   bool
+	serverName    string
+}
+
+type daemonConnector struct {
+	client    *rancher.RancherClient
+	secrets   secretStore
+	transport string
+	port      int
+	tls       *daemonTLS
+
+	// API versions negotiated with each host's daemon, keyed by host ID
+	sync.Mutex
+	versions map[string]string
+}
+
+func newDaemonConnector(c *rancher.RancherClient, transport string, port int, t *daemonTLS) (*daemonConnector, error) {
+	switch transport {
+	case transportTCP, transportHostAccess:
+	default:
+		return nil, fmt.Errorf("unknown daemon transport: %s", transport)
+	}
+	if port <= 0 {
+		port = dockerPort
+		if t != nil {
+			port = dockerTLSPort
+		}
+	}
+	return &daemonConnector{
+		client:    c,
+		secrets:   &rancherSecrets{c},
+		transport: transport,
+		port:      port,
+		tls:       t,
+		versions:  make(map[string]string),
+	}, nil
+}
+
+// loadDaemonTLS reads the default CA, client certificate and key. It returns
+// nil if TLS was not requested.
+func loadDaemonTLS(caFile, certFile, keyFile string, hostSecrets bool, serverName string) (*daemonTLS, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && !hostSecrets {
+		return nil, nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("tls-cert and tls-key must be specified together")
+	}
+	switch serverName {
+	case serverNameIP, serverNameHostname:
+	default:
+		return nil, fmt.Errorf("unknown tls-server-name: %s", serverName)
+	}
+
+	t := &daemonTLS{
+		hostSecrets: hostSecrets,
+		serverName:  serverName,
+	}
+	for _, f := range []struct {
+		name string
+		dst  *[]byte
+	}{
+		{caFile, &t.ca},
+		{certFile, &t.cert},
+		{keyFile, &t.key},
+	} {
+		if f.name == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(f.name)
+		if err != nil {
+			return nil, err
+		}
+		*f.dst = b
+	}
+	return t, nil
+}
+
+func (d *daemonConnector) connect(ctx context.Context, h rancher.Host) (swarmDaemon, error) {
+	d.Lock()
+	version, negotiated := d.versions[h.Id]
+	d.Unlock()
+	if !negotiated {
+		version = api.DefaultVersion
+	}
+
+	cli, err := d.newClient(h, version)
+	if err != nil {
+		return nil, err
+	}
+	if negotiated {
+		return cli, nil
+	}
+
+	// only a daemon that answered has a version worth remembering
+	if p, err := cli.Ping(ctx); err == nil {
+		cli.NegotiateAPIVersionPing(p)
+		d.Lock()
+		d.versions[h.Id] = cli.ClientVersion()
+		d.Unlock()
+	}
+	return cli, nil
+}
+
+// evict forgets the API version negotiated with the host, which is negotiated
+// again on the next connection in case the daemon was upgraded.
+func (d *daemonConnector) evict(id string) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.versions, id)
+}
+
+// retain forgets the API versions of hosts that are no longer registered.
+func (d *daemonConnector) retain(hosts []rancher.Host) {
+	ids := hostIDs(hosts)
+
+	d.Lock()
+	defer d.Unlock()
+	for id := range d.versions {
+		if !ids[id] {
+			delete(d.versions, id)
+		}
+	}
+}
+
+func (d *daemonConnector) newClient(h rancher.Host, version string) (*client.Client, error) {
+	address := fmt.Sprintf("tcp://%s:%d", h.AgentIpAddress, d.port)
+
+	switch {
+	case d.transport == transportHostAccess:
+		dial, err := dockerapiproxy.NewDialer(d.client, h.Id)
+		if err != nil {
+			return nil, err
+		}
+		// the dialer ignores the address, but the client requires one
+		httpClient := &http.Client{
+			Transport: &http.Transport{
+				Dial: dial,
+			},
+		}
+		return client.NewClient(address, version, httpClient, nil)
+
+	case d.tls != nil:
+		config, err := d.tlsConfig(h)
+		if err != nil {
+			return nil, err
+		}
+		httpClient := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: config,
+			},
+		}
+		return client.NewClient(address, version, httpClient, nil)
+
+	default:
+		return client.NewClient(address, version, nil, nil)
+	}
+}
+
+func (d *daemonConnector) tlsConfig(h rancher.Host) (*tls.Config, error) {
+	ca, cert, key := d.tls.ca, d.tls.cert, d.tls.key
+
+	// host labels override the defaults
+	if d.tls.hostSecrets {
+		for label, dst := range map[string]*[]byte{
+			labelTLSCA:   &ca,
+			labelTLSCert: &cert,
+			labelTLSKey:  &key,
+		} {
+			name, _ := h.Labels[label].(string)
+			if name == "" {
+				continue
+			}
+			v, _, err := d.secrets.getSecret(name)
+			if err != nil {
+				return nil, err
+			}
+			if v == "" {
+				return nil, fmt.Errorf("secret not found: %s", name)
+			}
+			*dst = []byte(v)
+		}
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	switch d.tls.serverName {
+	case serverNameHostname:
+		config.ServerName = h.Hostname
+	default:
+		config.ServerName = h.AgentIpAddress
+	}
+
+	if len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no CA certificates found for host %s", h.Id)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(cert) > 0 || len(key) > 0 {
+		c, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate for host %s: %v", h.Id, err)
+		}
+		config.Certificates = []tls.Certificate{c}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+// domain returns the failure domain of a host, the value of its
+// failureDomainLabel. Hosts without the label share the "" domain.
+func (r *Reconcile) domain(h rancher.Host) string {
+	v, ok := h.Labels[r.failureDomainLabel]
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// managerDomains counts the managers in each failure domain.
+func (r *Reconcile) managerDomains() map[string]int {
+	counts := make(map[string]int)
+	for _, h := range r.managerHosts {
+		counts[r.domain(h)]++
+	}
+	return counts
+}
+
+// rebalanceManagers swaps a manager from the most crowded failure domain for
+// a worker of the emptiest one, when that narrows the spread by moving one
+// manager. The worker is promoted first so that quorum never depends on the
+// demoted manager.
+func (r *Reconcile) rebalanceManagers() {
+	if r.failureDomainLabel == "" || len(r.managerHosts) == 0 || len(r.workerHosts) == 0 {
+		return
+	}
+
+	counts := r.managerDomains()
+	w := r.pickManager(r.workerHosts)
+	m, ok := r.pickDemotion(r.managerHosts)
+	if !ok || counts[r.domain(m)]-counts[r.domain(w)] < 2 {
+		return
+	}
+
+	r.plan.Decision = "rebalance-managers"
+	r.plan.add(Step{Action: StepPromote, HostID: w.Id, NodeID: r.hostInfo[w.Id].Swarm.NodeID})
+	r.plan.add(Step{Action: StepDemote, HostID: m.Id, NodeID: r.hostInfo[m.Id].Swarm.NodeID})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFailureDomains(t *testing.T) {
+	tests := []struct {
+		name         string
+		hosts        []string
+		zones        []string
+		managerCount int
+		decision     string
+		hostIDs      map[StepAction]string
+		demoteZone   string
+	}{
+		{
+			name:         "add manager in an empty zone",
+			hosts:        []string{"manager", "inactive", "inactive", "inactive"},
+			zones:        []string{"a", "a", "b", "a"},
+			managerCount: 3,
+			decision:     "add-manager",
+			hostIDs:      map[StepAction]string{StepJoinManager: "1h3"},
+		},
+		{
+			name:         "promote worker in an empty zone",
+			hosts:        []string{"manager", "worker", "worker", "worker"},
+			zones:        []string{"a", "a", "a", "c"},
+			managerCount: 3,
+			decision:     "promote-worker",
+			hostIDs:      map[StepAction]string{StepPromote: "1h4"},
+		},
+		{
+			name:         "demote manager in the most crowded zone",
+			hosts:        []string{"manager", "manager", "manager", "manager"},
+			zones:        []string{"a", "b", "b", "c"},
+			managerCount: 3,
+			decision:     "demote-manager",
+			demoteZone:   "b",
+		},
+		{
+			name:         "swap managers to spread them",
+			hosts:        []string{"manager", "manager", "manager", "worker", "worker"},
+			zones:        []string{"a", "a", "b", "c", "a"},
+			managerCount: 3,
+			decision:     "rebalance-managers",
+			hostIDs:      map[StepAction]string{StepPromote: "1h4"},
+			demoteZone:   "a",
+		},
+		{
+			name:         "spread as good as it gets",
+			hosts:        []string{"manager", "manager", "manager", "worker"},
+			zones:        []string{"a", "a", "b", "b"},
+			managerCount: 3,
+			decision:     "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCluster(tt.hosts, nil)
+			for i, zone := range tt.zones {
+				c.hosts[i].Labels["zone"] = zone
+			}
+			r := newReconciliation(c, c, reconcileOptions{
+				managerCount:       tt.managerCount,
+				failureDomainLabel: "zone",
+				selectionPolicy:    []string{selectSpread},
+			})
+			defer r.cleanup()
+
+			if err := r.observe(); err != nil {
+				t.Fatalf("observe: %v", err)
+			}
+			if err := r.analyze(); err != nil {
+				t.Fatalf("analyze: %v", err)
+			}
+			if r.plan.Decision != tt.decision {
+				t.Fatalf("decision = %q, want %q (plan: %v)", r.plan.Decision, tt.decision, r.plan)
+			}
+			for _, s := range r.plan.Steps {
+				if want, ok := tt.hostIDs[s.Action]; ok && s.HostID != want {
+					t.Errorf("%s on host %s, want %s", s.Action, s.HostID, want)
+				}
+				if s.Action == StepDemote && r.domain(r.host(s.HostID)) != tt.demoteZone {
+					t.Errorf("demoted host %s in zone %q, want %q", s.HostID, r.domain(r.host(s.HostID)), tt.demoteZone)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// countTasks counts the running tasks of draining orphans, the only nodes
+// whose tasks decide what happens next.
+func (r *Reconcile) countTasks() {
+	m := r.managerClient()
+	if m == nil {
+		return
+	}
+	for _, n := range r.hostNodes.orphans(r.nodes) {
+		if n.Spec.Availability != swarm.NodeAvailabilityDrain || n.Status.State == swarm.NodeStateDown {
+			continue
+		}
+		args := filters.NewArgs()
+		args.Add("node", n.ID)
+		args.Add("desired-state", string(swarm.TaskStateRunning))
+		ctx, cancel := r.callContext(r.infoTimeout)
+		tasks, err := m.TaskList(ctx, types.TaskListOptions{Filters: args})
+		cancel()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id":    n.ID,
+				"error": err.Error(),
+			}).Warn("Failed to list tasks")
+			continue
+		}
+		r.runningTasks[n.ID] = len(tasks)
+	}
+}
+
+// drainKey is the tracker key of a node's drain, which mustn't share the
+// node ID with the reachability deadManagers tracks.
+func drainKey(nodeID string) string {
+	return "drain/" + nodeID
+}
+
+// removeOrphans returns the steps that drain nodes that no longer have a host,
+// then demote and remove them once their tasks were rescheduled, or once
+// drainTimeout has passed since the drain was first seen. Down nodes have no
+// tasks left to wait for and are removed right away. Docker only removes a
+// node that isn't down by force, so draining is what keeps the removal
+// graceful.
+func (r *Reconcile) removeOrphans(orphans []swarm.Node) []Step {
+	now := time.Now()
+	var steps []Step
+	var remove []swarm.Node
+	for _, n := range orphans {
+		tasks := r.runningTasks[n.ID]
+		// UpdatedAt changes with any update, so the drain is timed from
+		// when it was first observed
+		draining := r.tracker.observe(drainKey(n.ID), string(n.Spec.Availability), now)
+		switch {
+		case n.Status.State == swarm.NodeStateDown:
+		case n.Spec.Availability != swarm.NodeAvailabilityDrain:
+			steps = append(steps, Step{Action: StepDrain, NodeID: n.ID})
+			continue
+		case tasks > 0 && draining < r.drainTimeout:
+			log.WithFields(log.Fields{
+				"id":    n.ID,
+				"tasks": tasks,
+			}).Info("Waiting for node to drain")
+			continue
+		case tasks > 0:
+			log.WithFields(log.Fields{
+				"id":    n.ID,
+				"tasks": tasks,
+			}).Warn("Node didn't drain in time")
+		}
+		remove = append(remove, n)
+	}
+
+	for _, n := range remove {
+		if n.Spec.Role == swarm.NodeRoleManager {
+			steps = append(steps, Step{Action: StepDemote, NodeID: n.ID})
+		}
+	}
+	for _, n := range remove {
+		steps = append(steps, Step{Action: StepRemove, NodeID: n.ID, Force: n.Status.State != swarm.NodeStateDown})
+	}
+	return steps
+}
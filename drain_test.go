@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   []string
+		role    swarm.NodeRole
+		state   swarm.NodeState
+		drained time.Duration
+		// updated is how long ago the node was last updated, when it differs
+		// from when the orchestrator saw the drain start
+		updated time.Duration
+		tasks   int
+		calls   map[string]int
+	}{
+		{
+			name:  "drain first",
+			role:  swarm.NodeRoleWorker,
+			calls: map[string]int{"update node3 role=worker availability=drain": 1, "remove": 0},
+		},
+		{
+			name:    "remove drained worker",
+			role:    swarm.NodeRoleWorker,
+			drained: time.Second,
+			calls:   map[string]int{"update": 0, "remove node3 force=true": 1},
+		},
+		{
+			name:    "demote and remove drained manager",
+			role:    swarm.NodeRoleManager,
+			drained: time.Second,
+			calls:   map[string]int{"update node3 role=worker availability=drain": 1, "remove node3 force=true": 1},
+		},
+		{
+			name:    "wait for tasks",
+			role:    swarm.NodeRoleWorker,
+			drained: time.Second,
+			tasks:   2,
+			calls:   map[string]int{"update": 0, "remove": 0},
+		},
+		{
+			name:    "remove after drain timeout",
+			role:    swarm.NodeRoleWorker,
+			drained: time.Hour,
+			tasks:   2,
+			calls:   map[string]int{"remove node3 force=true": 1},
+		},
+		{
+			name:    "drained before it was seen",
+			role:    swarm.NodeRoleWorker,
+			updated: time.Hour,
+			tasks:   2,
+			calls:   map[string]int{"remove": 0},
+		},
+		{
+			name:    "join while waiting for tasks",
+			hosts:   []string{"manager", "worker", "inactive"},
+			role:    swarm.NodeRoleWorker,
+			drained: time.Second,
+			tasks:   2,
+			calls:   map[string]int{"join 1h3": 1, "remove": 0},
+		},
+		{
+			name:  "down node needs no drain",
+			role:  swarm.NodeRoleWorker,
+			state: swarm.NodeStateDown,
+			calls: map[string]int{"update": 0, "remove node3 force=false": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := tt.hosts
+			if hosts == nil {
+				hosts = []string{"manager", "worker"}
+			}
+			c := newTestCluster(hosts, []swarm.NodeRole{tt.role})
+			orphan := c.nodes[len(c.nodes)-1].ID
+			n := c.node(orphan)
+			tracker := newHostTracker()
+			if tt.drained > 0 {
+				n.Spec.Availability = swarm.NodeAvailabilityDrain
+				n.UpdatedAt = time.Now().Add(-tt.drained)
+				tracker.observe(drainKey(orphan), string(swarm.NodeAvailabilityDrain), time.Now().Add(-tt.drained))
+			}
+			if tt.updated > 0 {
+				n.Spec.Availability = swarm.NodeAvailabilityDrain
+				n.UpdatedAt = time.Now().Add(-tt.updated)
+			}
+			if tt.state != "" {
+				n.Status.State = tt.state
+			}
+			c.tasks[orphan] = tt.tasks
+
+			opts := reconcileOptions{managerCount: 3, drainTimeout: time.Minute, tracker: tracker}
+			if err := newReconciliation(c, c, opts).run(context.Background()); err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			for prefix, want := range tt.calls {
+				if got := c.count(prefix); got != want {
+					t.Errorf("%q calls = %d, want %d (calls: %v)", prefix, got, want, c.calls)
+				}
+			}
+		})
+	}
+}
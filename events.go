@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gorilla/websocket"
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+const (
+	// eventRetry is how long a lost event stream waits before reconnecting.
+	eventRetry = 5 * time.Second
+	// eventReadTimeout is how long the Rancher event stream may stay silent,
+	// pongs included, before it is considered lost.
+	eventReadTimeout = time.Minute
+)
+
+// debouncer turns bursts of events into a single trigger, sent once no
+// event arrived for the debounce period. Triggers that aren't consumed yet
+// are coalesced.
+type debouncer struct {
+	sync.Mutex
+	period  time.Duration
+	timer   *time.Timer
+	trigger chan struct{}
+}
+
+func newDebouncer(period time.Duration) *debouncer {
+	return &debouncer{
+		period:  period,
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+func (d *debouncer) notify(reason string) {
+	log.WithField("reason", reason).Debug("Change event")
+
+	d.Lock()
+	defer d.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.timer = time.AfterFunc(d.period, func() {
+		select {
+		case d.trigger <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// rancherEvent is the part of a Rancher event the orchestrator looks at.
+type rancherEvent struct {
+	Name         string `json:"name"`
+	ResourceType string `json:"resourceType"`
+	ResourceID   string `json:"resourceId"`
+}
+
+// watchRancher notifies of every change to a host until ctx is done.
+func watchRancher(ctx context.Context, client *rancher.RancherClient, notify func(string)) {
+	for ctx.Err() == nil {
+		if err := watchRancherEvents(ctx, client, notify); err != nil {
+			log.WithField("error", err.Error()).Warn("Rancher event stream lost")
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(eventRetry):
+		}
+	}
+}
+
+func watchRancherEvents(ctx context.Context, client *rancher.RancherClient, notify func(string)) error {
+	schema, ok := client.GetSchemas().CheckSchema("subscribe")
+	if !ok {
+		return errors.New("Rancher API has no subscribe endpoint")
+	}
+	url := schema.Links["collection"] + "?eventNames=resource.change"
+	url = "ws" + strings.TrimPrefix(url, "http")
+
+	conn, _, err := client.Websocket(url, nil)
+	if err != nil {
+		return err
+	}
+	log.Info("Watching Rancher host changes")
+	return readRancherEvents(ctx, conn, eventReadTimeout, notify)
+}
+
+// readRancherEvents reads host changes from the event stream until ctx is
+// done or the stream is lost. The stream is pinged every half timeout, and
+// considered lost once nothing, not even a pong, was read for timeout: a
+// half-open connection would otherwise block forever.
+func readRancherEvents(ctx context.Context, conn *websocket.Conn, timeout time.Duration, notify func(string)) error {
+	defer conn.Close()
+
+	extend := func() error {
+		return conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	extend()
+	conn.SetPongHandler(func(string) error {
+		return extend()
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(timeout / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-done:
+				return
+			case <-t.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout/2))
+			}
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		extend()
+		var e rancherEvent
+		if err := json.Unmarshal(msg, &e); err != nil {
+			continue
+		}
+		if e.Name == "resource.change" && e.ResourceType == "host" {
+			notify("host " + e.ResourceID)
+		}
+	}
+}
+
+// watchDocker notifies of every swarm node event seen by a manager until ctx
+// is done. Finding the manager times out like any call that reads daemon
+// state, after timeout.
+func watchDocker(ctx context.Context, i hostInventory, d daemonDialer, timeout time.Duration, notify func(string)) {
+	for ctx.Err() == nil {
+		if err := watchDockerEvents(ctx, i, d, timeout, notify); err != nil {
+			log.WithField("error", err.Error()).Warn("Docker event stream lost")
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(eventRetry):
+		}
+	}
+}
+
+func watchDockerEvents(ctx context.Context, i hostInventory, d daemonDialer, timeout time.Duration, notify func(string)) error {
+	m, err := connectManager(ctx, i, d, timeout)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	args := filters.NewArgs()
+	args.Add("type", "node")
+	msgs, errs := m.Events(ctx, types.EventsOptions{Filters: args})
+
+	log.Info("Watching swarm node events")
+	for {
+		select {
+		case msg := <-msgs:
+			notify("node " + msg.Actor.ID + " " + msg.Action)
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// connectManager connects to the daemon of any reachable manager, giving each
+// host up to timeout to answer.
+func connectManager(ctx context.Context, i hostInventory, d daemonDialer, timeout time.Duration) (swarmDaemon, error) {
+	hosts, err := i.listHosts()
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		if m := connectIfManager(ctx, d, h, timeout); m != nil {
+			return m, nil
+		}
+	}
+	return nil, errNoManager
+}
+
+func connectIfManager(ctx context.Context, d daemonDialer, h rancher.Host, timeout time.Duration) swarmDaemon {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	c, err := d.connect(ctx, h)
+	if err != nil {
+		return nil
+	}
+	if info, err := c.Info(ctx); err == nil && info.Swarm.ControlAvailable {
+		return c
+	}
+	c.Close()
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/gorilla/websocket"
+)
+
+func TestDebouncer(t *testing.T) {
+	d := newDebouncer(20 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		d.notify("host")
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	select {
+	case <-d.trigger:
+	case <-time.After(time.Second):
+		t.Fatal("no trigger after a burst of events")
+	}
+	select {
+	case <-d.trigger:
+		t.Fatal("a burst of events triggered more than once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatchDocker(t *testing.T) {
+	c := newTestCluster([]string{"worker", "manager"}, nil)
+	c.events = []events.Message{{Type: "node", Action: "update", Actor: events.Actor{ID: "node1"}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	notified := make(chan string, 1)
+	done := make(chan struct{})
+	go func() {
+		watchDocker(ctx, c, c, time.Second, func(reason string) { notified <- reason })
+		close(done)
+	}()
+
+	select {
+	case reason := <-notified:
+		if reason != "node node1 update" {
+			t.Errorf("reason = %q", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("node event not notified")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchDocker didn't stop")
+	}
+}
+
+func TestReadRancherEvents(t *testing.T) {
+	// the server sends a host change, then goes silent without answering
+	// pings, like a half-open connection
+	release := make(chan struct{})
+	defer close(release)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"name":"resource.change","resourceType":"host","resourceId":"1h1"}`))
+		<-release
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	var reasons []string
+	done := make(chan error, 1)
+	go func() {
+		done <- readRancherEvents(context.Background(), conn, 50*time.Millisecond, func(reason string) {
+			reasons = append(reasons, reason)
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("silent stream ended without an error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("silent stream wasn't considered lost")
+	}
+	if len(reasons) != 1 || reasons[0] != "host 1h1" {
+		t.Errorf("notified %v, want [host 1h1]", reasons)
+	}
+}
+
+func TestConnectManagerTimeout(t *testing.T) {
+	c := newTestCluster([]string{"manager", "manager"}, nil)
+	d := &hangingDialer{dialer: c, hung: map[string]bool{"1h1": true}}
+
+	// the hung manager is skipped once it timed out
+	start := time.Now()
+	m, err := connectManager(context.Background(), c, d, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("connectManager: %v", err)
+	}
+	if info, _ := m.Info(context.Background()); info.Swarm.NodeID != "node2" {
+		t.Errorf("connected to %s, want node2", info.Swarm.NodeID)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connectManager took %v", elapsed)
+	}
+}
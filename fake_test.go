@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+const (
+	fakeManagerToken = "SWMTKN-manager"
+	fakeWorkerToken  = "SWMTKN-worker"
+	fakeUnlockKey    = "SWMKEY-unlock"
+)
+
+// fakeCluster is an in-memory Rancher environment and swarm. It implements
+// hostInventory, daemonDialer and secretStore, and every daemon it hands out
+// shares the same swarm state.
+type fakeCluster struct {
+	sync.Mutex
+	id      string
+	hosts   []rancher.Host
+	daemons map[string]*fakeDaemon
+	nodes   []swarm.Node
+	calls   []string
+	nextID  int
+
+	autolock    bool
+	unlockKey   string
+	keyRotation int
+	secrets     map[string]fakeSecret
+	// failSecrets are the secrets that can't be written
+	failSecrets map[string]bool
+	metadata    map[string]string
+	tasks       map[string]int
+	events      []events.Message
+}
+
+type fakeSecret struct {
+	value   string
+	created time.Time
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{
+		daemons:   make(map[string]*fakeDaemon),
+		unlockKey: fakeUnlockKey,
+		secrets:   make(map[string]fakeSecret),
+
+		failSecrets: make(map[string]bool),
+		metadata:    make(map[string]string),
+		tasks:       make(map[string]int),
+	}
+}
+
+// addHost registers a host whose daemon is in the given state: inactive,
+// pending, error, manager, worker, locked (a manager of an autolocked swarm),
+// foreign (a manager of another swarm), unreachable (no daemon answers) or
+// down-manager (an unreachable host whose manager node the swarm reports
+// unreachable).
+func (c *fakeCluster) addHost(state string) rancher.Host {
+	n := len(c.hosts) + 1
+	h := rancher.Host{
+		Resource:       rancher.Resource{Id: fmt.Sprintf("1h%d", n)},
+		AgentIpAddress: fmt.Sprintf("10.0.0.%d", n),
+		Hostname:       fmt.Sprintf("host%d", n),
+		Uuid:           fmt.Sprintf("uuid-%d", n),
+		Labels:         map[string]interface{}{},
+	}
+	d := &fakeDaemon{cluster: c, host: h}
+
+	switch state {
+	case "manager", "worker":
+		c.id = "cluster-1"
+		d.state = swarm.LocalNodeStateActive
+		d.nodeID = c.addNode(h.AgentIpAddress, swarm.NodeRole(state))
+		c.node(d.nodeID).Description.Hostname = h.Hostname
+		if state == "manager" {
+			h.Labels["manager"] = ""
+		}
+	case "foreign":
+		d.state = swarm.LocalNodeStateActive
+		d.foreign = "cluster-2"
+	case "unreachable":
+		c.hosts = append(c.hosts, h)
+		return h
+	case "down-manager":
+		c.id = "cluster-1"
+		id := c.addNode(h.AgentIpAddress, swarm.NodeRoleManager)
+		n := c.node(id)
+		n.Status.State = swarm.NodeStateDown
+		n.ManagerStatus.Reachability = swarm.ReachabilityUnreachable
+		n.Spec.Labels = map[string]string{nodeLabelHostUUID: h.Uuid}
+		h.Labels["manager"] = ""
+		c.hosts = append(c.hosts, h)
+		return h
+	case "locked":
+		c.id = "cluster-1"
+		d.state = swarm.LocalNodeStateLocked
+		d.nodeID = c.addNode(h.AgentIpAddress, swarm.NodeRoleManager)
+		h.Labels["manager"] = ""
+	default:
+		d.state = swarm.LocalNodeState(state)
+	}
+
+	if d.nodeID != "" {
+		c.node(d.nodeID).Spec.Labels = map[string]string{nodeLabelHostUUID: h.Uuid}
+	}
+	c.hosts = append(c.hosts, h)
+	c.daemons[h.Id] = d
+	return h
+}
+
+// addOrphan adds a swarm node that no registered host corresponds to.
+func (c *fakeCluster) addOrphan(role swarm.NodeRole) string {
+	return c.addNode("192.168.0.1", role)
+}
+
+// addStale adds a down node left behind by an earlier incarnation of a host.
+func (c *fakeCluster) addStale(addr, hostname string, role swarm.NodeRole) string {
+	id := c.addNode(addr, role)
+	n := c.node(id)
+	n.Description.Hostname = hostname
+	n.Status.State = swarm.NodeStateDown
+	if n.ManagerStatus != nil {
+		n.ManagerStatus.Reachability = swarm.ReachabilityUnreachable
+	}
+	return id
+}
+
+func (c *fakeCluster) addNode(addr string, role swarm.NodeRole) string {
+	c.nextID++
+	n := swarm.Node{
+		ID: fmt.Sprintf("node%d", c.nextID),
+		Spec: swarm.NodeSpec{
+			Role:         role,
+			Availability: swarm.NodeAvailabilityActive,
+		},
+		Status: swarm.NodeStatus{
+			State: swarm.NodeStateReady,
+			Addr:  addr,
+		},
+	}
+	if role == swarm.NodeRoleManager {
+		n.ManagerStatus = &swarm.ManagerStatus{
+			Reachability: swarm.ReachabilityReachable,
+			Addr:         addr + ":2377",
+		}
+	}
+	c.nodes = append(c.nodes, n)
+	return n.ID
+}
+
+func (c *fakeCluster) node(id string) *swarm.Node {
+	for i := range c.nodes {
+		if c.nodes[i].ID == id {
+			return &c.nodes[i]
+		}
+	}
+	return nil
+}
+
+func (c *fakeCluster) record(format string, args ...interface{}) {
+	c.calls = append(c.calls, fmt.Sprintf(format, args...))
+}
+
+// count returns the number of recorded calls starting with prefix.
+func (c *fakeCluster) count(prefix string) int {
+	c.Lock()
+	defer c.Unlock()
+	n := 0
+	for _, call := range c.calls {
+		if strings.HasPrefix(call, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// labeled returns the number of hosts carrying the given label.
+func (c *fakeCluster) labeled(label string) int {
+	c.Lock()
+	defer c.Unlock()
+	n := 0
+	for _, h := range c.hosts {
+		if _, ok := h.Labels[label]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *fakeCluster) listHosts() ([]rancher.Host, error) {
+	c.Lock()
+	defer c.Unlock()
+	return append([]rancher.Host(nil), c.hosts...), nil
+}
+
+func (c *fakeCluster) updateHost(h rancher.Host) error {
+	c.Lock()
+	defer c.Unlock()
+	for i := range c.hosts {
+		if c.hosts[i].Id == h.Id {
+			c.hosts[i] = h
+			return nil
+		}
+	}
+	return fmt.Errorf("host not found: %s", h.Id)
+}
+
+func (c *fakeCluster) getSecret(name string) (string, time.Time, error) {
+	c.Lock()
+	defer c.Unlock()
+	s := c.secrets[name]
+	return s.value, s.created, nil
+}
+
+func (c *fakeCluster) putSecret(name, value string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.record("put-secret %s", name)
+	if c.failSecrets[name] {
+		return fmt.Errorf("secret %s can't be written", name)
+	}
+	c.secrets[name] = fakeSecret{value: value, created: time.Now()}
+	return nil
+}
+
+func (c *fakeCluster) getMetadata(key string) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.metadata[key], nil
+}
+
+func (c *fakeCluster) putMetadata(key, value string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.record("put-metadata %s=%s", key, value)
+	c.metadata[key] = value
+	return nil
+}
+
+func (c *fakeCluster) connect(ctx context.Context, h rancher.Host) (swarmDaemon, error) {
+	c.Lock()
+	defer c.Unlock()
+	d, ok := c.daemons[h.Id]
+	if !ok {
+		return nil, fmt.Errorf("no daemon for host %s", h.Id)
+	}
+	return d, nil
+}
+
+type fakeDaemon struct {
+	cluster *fakeCluster
+	host    rancher.Host
+	state   swarm.LocalNodeState
+	nodeID  string
+	// foreign is the ID of another swarm the daemon manages
+	foreign string
+	// lockKey unlocks a locked daemon, if not the swarm's current key
+	lockKey string
+}
+
+func (d *fakeDaemon) isManager() bool {
+	n := d.cluster.node(d.nodeID)
+	return d.state == swarm.LocalNodeStateActive && n != nil && n.Spec.Role == swarm.NodeRoleManager
+}
+
+func (d *fakeDaemon) Info(ctx context.Context) (types.Info, error) {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	info := types.Info{
+		Swarm: swarm.Info{
+			NodeID:           d.nodeID,
+			NodeAddr:         d.host.AgentIpAddress,
+			LocalNodeState:   d.state,
+			ControlAvailable: d.isManager(),
+		},
+	}
+	if d.foreign != "" {
+		info.Swarm.NodeID = "foreign-" + d.host.Id
+		info.Swarm.ControlAvailable = true
+		info.Swarm.Cluster = &swarm.ClusterInfo{ID: d.foreign}
+		return info, nil
+	}
+	if d.state == swarm.LocalNodeStateError {
+		info.Swarm.Error = "rpc error: code = Unavailable"
+	}
+	if d.state == swarm.LocalNodeStateActive {
+		info.Swarm.Cluster = &swarm.ClusterInfo{ID: c.id}
+		for _, n := range c.nodes {
+			if n.ManagerStatus != nil {
+				info.Swarm.RemoteManagers = append(info.Swarm.RemoteManagers, swarm.Peer{
+					NodeID: n.ID,
+					Addr:   n.ManagerStatus.Addr,
+				})
+			}
+		}
+	}
+	return info, nil
+}
+
+func (d *fakeDaemon) SwarmInit(ctx context.Context, req swarm.InitRequest) (string, error) {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if d.state != swarm.LocalNodeStateInactive {
+		return "", errors.New("node is already part of a swarm")
+	}
+	c.record("init %s", d.host.Id)
+	c.id = "cluster-1"
+	c.autolock = req.AutoLockManagers
+	d.state = swarm.LocalNodeStateActive
+	d.nodeID = c.addNode(req.AdvertiseAddr, swarm.NodeRoleManager)
+	return d.nodeID, nil
+}
+
+func (d *fakeDaemon) SwarmJoin(ctx context.Context, req swarm.JoinRequest) error {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if d.state != swarm.LocalNodeStateInactive {
+		return errors.New("node is already part of a swarm")
+	}
+	if len(req.RemoteAddrs) == 0 {
+		return errors.New("no remote managers")
+	}
+
+	var role swarm.NodeRole
+	switch req.JoinToken {
+	case fakeManagerToken:
+		role = swarm.NodeRoleManager
+	case fakeWorkerToken:
+		role = swarm.NodeRoleWorker
+	default:
+		return errors.New("invalid join token")
+	}
+	c.record("join %s %s", d.host.Id, role)
+	d.state = swarm.LocalNodeStateActive
+	d.nodeID = c.addNode(req.AdvertiseAddr, role)
+	return nil
+}
+
+func (d *fakeDaemon) SwarmInspect(ctx context.Context) (swarm.Swarm, error) {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if !d.isManager() {
+		return swarm.Swarm{}, errors.New("this node is not a swarm manager")
+	}
+	s := swarm.Swarm{
+		ClusterInfo: swarm.ClusterInfo{ID: c.id},
+		JoinTokens: swarm.JoinTokens{
+			Manager: fakeManagerToken,
+			Worker:  fakeWorkerToken,
+		},
+	}
+	s.Spec.EncryptionConfig.AutoLockManagers = c.autolock
+	return s, nil
+}
+
+func (d *fakeDaemon) SwarmUpdate(ctx context.Context, version swarm.Version, spec swarm.Spec, flags swarm.UpdateFlags) error {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if !d.isManager() {
+		return errors.New("this node is not a swarm manager")
+	}
+	c.record("swarm-update autolock=%t rotate=%t", spec.EncryptionConfig.AutoLockManagers, flags.RotateManagerUnlockKey)
+	c.autolock = spec.EncryptionConfig.AutoLockManagers
+	if flags.RotateManagerUnlockKey {
+		c.keyRotation++
+		c.unlockKey = fmt.Sprintf("SWMKEY-%d", c.keyRotation)
+	}
+	return nil
+}
+
+func (d *fakeDaemon) SwarmGetUnlockKey(ctx context.Context) (types.SwarmUnlockKeyResponse, error) {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if !d.isManager() {
+		return types.SwarmUnlockKeyResponse{}, errors.New("this node is not a swarm manager")
+	}
+	if !c.autolock {
+		return types.SwarmUnlockKeyResponse{}, errors.New("no unlock key is set")
+	}
+	return types.SwarmUnlockKeyResponse{UnlockKey: c.unlockKey}, nil
+}
+
+func (d *fakeDaemon) SwarmLeave(ctx context.Context, force bool) error {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if d.state == swarm.LocalNodeStateInactive {
+		return errors.New("this node is not part of a swarm")
+	}
+	if d.isManager() && !force {
+		return errors.New("managers must leave with force")
+	}
+	c.record("leave %s force=%t", d.host.Id, force)
+	d.state = swarm.LocalNodeStateInactive
+	d.nodeID = ""
+	d.foreign = ""
+	return nil
+}
+
+func (d *fakeDaemon) SwarmUnlock(ctx context.Context, req swarm.UnlockRequest) error {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if d.state != swarm.LocalNodeStateLocked {
+		return errors.New("swarm is not locked")
+	}
+	key := c.unlockKey
+	if d.lockKey != "" {
+		key = d.lockKey
+	}
+	if req.UnlockKey != key {
+		return errors.New("invalid unlock key")
+	}
+	c.record("unlock %s", d.host.Id)
+	d.state = swarm.LocalNodeStateActive
+	return nil
+}
+
+func (d *fakeDaemon) NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error) {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if !d.isManager() {
+		return nil, errors.New("this node is not a swarm manager")
+	}
+	return append([]swarm.Node(nil), c.nodes...), nil
+}
+
+func (d *fakeDaemon) NodeInspectWithRaw(ctx context.Context, nodeID string) (swarm.Node, []byte, error) {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if !d.isManager() {
+		return swarm.Node{}, nil, errors.New("this node is not a swarm manager")
+	}
+	n := c.node(nodeID)
+	if n == nil {
+		return swarm.Node{}, nil, fmt.Errorf("node %s not found", nodeID)
+	}
+	return *n, nil, nil
+}
+
+func (d *fakeDaemon) NodeUpdate(ctx context.Context, nodeID string, version swarm.Version, spec swarm.NodeSpec) error {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if !d.isManager() {
+		return errors.New("this node is not a swarm manager")
+	}
+	n := c.node(nodeID)
+	if n == nil {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+	c.record("update %s role=%s availability=%s", nodeID, spec.Role, spec.Availability)
+	n.Spec = spec
+	if spec.Role == swarm.NodeRoleManager && n.ManagerStatus == nil {
+		n.ManagerStatus = &swarm.ManagerStatus{
+			Reachability: swarm.ReachabilityReachable,
+			Addr:         n.Status.Addr + ":2377",
+		}
+	} else if spec.Role == swarm.NodeRoleWorker {
+		n.ManagerStatus = nil
+	}
+	return nil
+}
+
+func (d *fakeDaemon) NodeRemove(ctx context.Context, nodeID string, options types.NodeRemoveOptions) error {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if !d.isManager() {
+		return errors.New("this node is not a swarm manager")
+	}
+	for i, n := range c.nodes {
+		if n.ID == nodeID {
+			c.record("remove %s force=%t", nodeID, options.Force)
+			c.nodes = append(c.nodes[:i], c.nodes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("node %s not found", nodeID)
+}
+
+func (d *fakeDaemon) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if !d.isManager() {
+		return nil, errors.New("this node is not a swarm manager")
+	}
+	var tasks []swarm.Task
+	for _, id := range options.Filters.Get("node") {
+		for i := 0; i < c.tasks[id]; i++ {
+			tasks = append(tasks, swarm.Task{NodeID: id})
+		}
+	}
+	return tasks, nil
+}
+
+func (d *fakeDaemon) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	errs := make(chan error, 1)
+	if !d.isManager() {
+		errs <- errors.New("this node is not a swarm manager")
+		return nil, errs
+	}
+	msgs := make(chan events.Message, len(d.cluster.events))
+	for _, e := range d.cluster.events {
+		msgs <- e
+	}
+	go func() {
+		<-ctx.Done()
+		errs <- ctx.Err()
+	}()
+	return msgs, errs
+}
+
+func (d *fakeDaemon) NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error) {
+	c := d.cluster
+	c.Lock()
+	defer c.Unlock()
+
+	if !d.isManager() {
+		return types.NetworkCreateResponse{}, errors.New("this node is not a swarm manager")
+	}
+	c.record("network %s", name)
+	return types.NetworkCreateResponse{ID: "net-" + name}, nil
+}
+
+func (d *fakeDaemon) Ping(ctx context.Context) (types.Ping, error) {
+	return types.Ping{APIVersion: "1.30"}, nil
+}
+
+func (d *fakeDaemon) Close() error {
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+// nodeLabelHostUUID is the swarm node label that records the UUID of the
+// Rancher host a node runs on.
+const nodeLabelHostUUID = "io.rancher.host.uuid"
+
+// hostNodeMap pairs Rancher hosts with swarm nodes. Keys are tried from the
+// most to the least stable, each host and node being paired at most once:
+//
+//  1. the node ID reported by the host's Docker engine
+//  2. the host UUID node label
+//  3. the hostname
+//  4. the IP address, which NAT and re-addressed hosts make unreliable
+type hostNodeMap struct {
+	nodes  map[string]swarm.Node   // by host ID
+	hosts  map[string]rancher.Host // by node ID
+	labels map[string]string       // host UUID to record, by node ID
+	// identified holds the node IDs paired by engine node ID or UUID label,
+	// rather than by hostname or address
+	identified map[string]bool
+}
+
+func newHostNodeMap(hosts []rancher.Host, info map[string]types.Info, nodes []swarm.Node) *hostNodeMap {
+	m := &hostNodeMap{
+		nodes:  make(map[string]swarm.Node),
+		hosts:  make(map[string]rancher.Host),
+		labels: make(map[string]string),
+
+		identified: make(map[string]bool),
+	}
+
+	keys := []func(h rancher.Host, n swarm.Node) bool{
+		func(h rancher.Host, n swarm.Node) bool {
+			i, ok := info[h.Id]
+			return ok && i.Swarm.NodeID != "" && i.Swarm.NodeID == n.ID
+		},
+		func(h rancher.Host, n swarm.Node) bool {
+			return h.Uuid != "" && n.Spec.Labels[nodeLabelHostUUID] == h.Uuid
+		},
+		func(h rancher.Host, n swarm.Node) bool {
+			return h.Hostname != "" && n.Description.Hostname == h.Hostname
+		},
+		func(h rancher.Host, n swarm.Node) bool {
+			return h.AgentIpAddress != "" && n.Status.Addr == h.AgentIpAddress
+		},
+	}
+	for i, matches := range keys {
+		for _, h := range hosts {
+			if _, ok := m.nodes[h.Id]; ok {
+				continue
+			}
+			for _, n := range nodes {
+				if _, ok := m.hosts[n.ID]; ok || !matches(h, n) {
+					continue
+				}
+				m.nodes[h.Id] = n
+				m.hosts[n.ID] = h
+				if i < 2 {
+					m.identified[n.ID] = true
+				}
+				// only the engine's own word is good enough to label a node
+				if i == 0 && h.Uuid != "" && n.Spec.Labels[nodeLabelHostUUID] != h.Uuid {
+					m.labels[n.ID] = h.Uuid
+				}
+				break
+			}
+		}
+	}
+	return m
+}
+
+// node returns the swarm node of a host.
+func (m *hostNodeMap) node(hostID string) (swarm.Node, bool) {
+	n, ok := m.nodes[hostID]
+	return n, ok
+}
+
+// host returns the Rancher host of a swarm node.
+func (m *hostNodeMap) host(nodeID string) (rancher.Host, bool) {
+	h, ok := m.hosts[nodeID]
+	return h, ok
+}
+
+// orphans returns the nodes no host was paired with, in the given order.
+func (m *hostNodeMap) orphans(nodes []swarm.Node) []swarm.Node {
+	var orphans []swarm.Node
+	for _, n := range nodes {
+		if _, ok := m.hosts[n.ID]; !ok {
+			orphans = append(orphans, n)
+		}
+	}
+	return orphans
+}
+
+// planNodeLabels records the host UUID on nodes whose host is known for sure,
+// so they can still be paired once the host is unreachable or re-addressed,
+// and keeps the synced host labels of every paired node current.
+func (r *Reconcile) planNodeLabels() {
+	var steps []Step
+	for _, h := range r.registeredHosts {
+		n, ok := r.hostNodes.node(h.Id)
+		if !ok {
+			continue
+		}
+		set, remove := r.labelChanges(h, n)
+		if uuid, ok := r.hostNodes.labels[n.ID]; ok {
+			set[nodeLabelHostUUID] = uuid
+		}
+		if len(set) == 0 && len(remove) == 0 {
+			continue
+		}
+		step := Step{Action: StepLabelNode, HostID: h.Id, NodeID: n.ID, RemoveLabels: remove}
+		if len(set) > 0 {
+			step.Labels = set
+		}
+		steps = append(steps, step)
+	}
+
+	if len(steps) == 0 {
+		return
+	}
+	if r.plan.Decision == "" {
+		r.plan.Decision = "label-nodes"
+	}
+	for _, step := range steps {
+		r.plan.add(step)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+func TestHostNodeMap(t *testing.T) {
+	host := func(id, uuid, hostname, ip string) rancher.Host {
+		return rancher.Host{
+			Resource:       rancher.Resource{Id: id},
+			Uuid:           uuid,
+			Hostname:       hostname,
+			AgentIpAddress: ip,
+		}
+	}
+	node := func(id, uuid, hostname, addr string) swarm.Node {
+		n := swarm.Node{ID: id}
+		if uuid != "" {
+			n.Spec.Labels = map[string]string{nodeLabelHostUUID: uuid}
+		}
+		n.Description.Hostname = hostname
+		n.Status.Addr = addr
+		return n
+	}
+
+	hosts := []rancher.Host{
+		host("1h1", "uuid-1", "host1", "10.0.0.1"),
+		host("1h2", "uuid-2", "host2", "10.0.0.2"),
+		host("1h3", "uuid-3", "host3", "10.0.0.3"),
+		host("1h4", "uuid-4", "host4", "10.0.0.4"),
+	}
+	nodes := []swarm.Node{
+		// behind NAT, only the engine knows its node
+		node("node1", "", "nat", "172.16.0.1"),
+		// re-addressed and unreachable, paired by label
+		node("node2", "uuid-2", "host2", "10.0.1.2"),
+		// not labeled yet, paired by hostname although the IP is taken
+		node("node3", "", "host3", "10.0.0.4"),
+		// paired by IP
+		node("node4", "", "", "10.0.0.1"),
+		node("node5", "", "old", "10.0.0.9"),
+	}
+	info := map[string]types.Info{
+		"1h1": {Swarm: swarm.Info{NodeID: "node1"}},
+	}
+
+	m := newHostNodeMap(hosts, info, nodes)
+
+	want := map[string]string{"1h1": "node1", "1h2": "node2", "1h3": "node3"}
+	for hostID, nodeID := range want {
+		n, ok := m.node(hostID)
+		if !ok || n.ID != nodeID {
+			t.Errorf("node(%s) = %s, want %s", hostID, n.ID, nodeID)
+		}
+		if h, _ := m.host(nodeID); h.Id != hostID {
+			t.Errorf("host(%s) = %s, want %s", nodeID, h.Id, hostID)
+		}
+	}
+	// node4's address belongs to host1, which is already paired
+	if n, ok := m.node("1h4"); ok {
+		t.Errorf("node(1h4) = %s, want none", n.ID)
+	}
+
+	orphans := m.orphans(nodes)
+	if len(orphans) != 2 || orphans[0].ID != "node4" || orphans[1].ID != "node5" {
+		t.Errorf("orphans = %v, want node4 and node5", orphans)
+	}
+	if len(m.labels) != 1 || m.labels["node1"] != "uuid-1" {
+		t.Errorf("labels = %v, want node1=uuid-1", m.labels)
+	}
+}
+
+func TestNodeLabels(t *testing.T) {
+	c := newTestCluster([]string{"manager", "manager", "manager", "worker"}, nil)
+	c.node("node4").Spec.Labels = nil
+
+	r := newReconciliation(c, c, reconcileOptions{managerCount: 3})
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if r.plan.Decision != "label-nodes" || len(r.plan.Steps) != 1 {
+		t.Errorf("plan = %v, want a single label-nodes step", r.plan)
+	}
+	if got := c.node("node4").Spec.Labels[nodeLabelHostUUID]; got != "uuid-4" {
+		t.Errorf("node4 label = %q, want uuid-4", got)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+// hostInventory lists and updates the hosts registered in the environment.
+type hostInventory interface {
+	listHosts() ([]rancher.Host, error)
+	updateHost(h rancher.Host) error
+}
+
+type rancherInventory struct {
+	client *rancher.RancherClient
+}
+
+func (i *rancherInventory) listHosts() ([]rancher.Host, error) {
+	h, err := i.client.Host.List(nil)
+	if err != nil {
+		return nil, err
+	}
+	return h.Data, nil
+}
+
+func (i *rancherInventory) updateHost(h rancher.Host) error {
+	_, err := i.client.Host.Update(&h, h)
+	return err
+}
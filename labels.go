@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+// nodeLabelSynced lists the node labels copied from the host, so that only
+// those are removed again when the host loses them.
+const nodeLabelSynced = "io.rancher.swarmkit.synced-labels"
+
+// syncsLabel reports whether a host label is copied to the host's node.
+func (r *Reconcile) syncsLabel(key string) bool {
+	if r.nodeLabelPrefix != "" && strings.HasPrefix(key, r.nodeLabelPrefix) {
+		return true
+	}
+	for _, k := range r.nodeLabels {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// labelChanges returns the node labels to set and remove to mirror the
+// host's synced labels. Node labels that were never copied from the host are
+// left alone.
+func (r *Reconcile) labelChanges(h rancher.Host, n swarm.Node) (map[string]string, []string) {
+	want := make(map[string]string)
+	for k, v := range h.Labels {
+		if k == nodeLabelSynced || !r.syncsLabel(k) {
+			continue
+		}
+		if s, ok := v.(string); ok {
+			want[k] = s
+		} else {
+			want[k] = fmt.Sprint(v)
+		}
+	}
+
+	set := make(map[string]string)
+	for k, v := range want {
+		if cur, ok := n.Spec.Labels[k]; !ok || cur != v {
+			set[k] = v
+		}
+	}
+
+	var remove []string
+	for _, k := range strings.Split(n.Spec.Labels[nodeLabelSynced], ",") {
+		if _, ok := want[k]; !ok && k != "" {
+			if _, ok := n.Spec.Labels[k]; ok {
+				remove = append(remove, k)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	synced := strings.Join(keys, ",")
+	if cur, ok := n.Spec.Labels[nodeLabelSynced]; synced != cur {
+		if synced != "" {
+			set[nodeLabelSynced] = synced
+		} else if ok {
+			remove = append(remove, nodeLabelSynced)
+		}
+	}
+
+	sort.Strings(remove)
+	return set, remove
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestLabelSync(t *testing.T) {
+	tests := []struct {
+		name       string
+		hostLabels map[string]interface{}
+		nodeLabels map[string]string
+		want       map[string]string
+	}{
+		{
+			name:       "copy matching labels",
+			hostLabels: map[string]interface{}{"zone": "a", "io.example.disk": "ssd", "other": "x"},
+			want: map[string]string{
+				nodeLabelHostUUID: "uuid-4",
+				"zone":            "a",
+				"io.example.disk": "ssd",
+				nodeLabelSynced:   "io.example.disk,zone",
+			},
+		},
+		{
+			name:       "update changed label",
+			hostLabels: map[string]interface{}{"zone": "b"},
+			nodeLabels: map[string]string{"zone": "a", nodeLabelSynced: "zone"},
+			want:       map[string]string{nodeLabelHostUUID: "uuid-4", "zone": "b", nodeLabelSynced: "zone"},
+		},
+		{
+			name:       "remove label removed from host",
+			hostLabels: map[string]interface{}{"zone": "a"},
+			nodeLabels: map[string]string{"zone": "a", "io.example.disk": "ssd", nodeLabelSynced: "io.example.disk,zone"},
+			want:       map[string]string{nodeLabelHostUUID: "uuid-4", "zone": "a", nodeLabelSynced: "zone"},
+		},
+		{
+			name:       "leave unmanaged labels alone",
+			hostLabels: map[string]interface{}{},
+			nodeLabels: map[string]string{"zone": "a", "io.example.disk": "hdd", nodeLabelSynced: "zone"},
+			want:       map[string]string{nodeLabelHostUUID: "uuid-4", "io.example.disk": "hdd"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCluster([]string{"manager", "manager", "manager", "worker"}, nil)
+			c.hosts[3].Labels = tt.hostLabels
+			n := c.node("node4")
+			for k, v := range tt.nodeLabels {
+				n.Spec.Labels[k] = v
+			}
+
+			opts := reconcileOptions{
+				managerCount:    3,
+				nodeLabelPrefix: "io.example.",
+				nodeLabels:      []string{"zone"},
+			}
+			if err := newReconciliation(c, c, opts).run(context.Background()); err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if got := c.node("node4").Spec.Labels; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("labels = %v, want %v", got, tt.want)
+			}
+
+			// a second pass has nothing left to do
+			r := newReconciliation(c, c, opts)
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if len(r.plan.Steps) > 0 {
+				t.Errorf("unexpected plan: %v", r.plan)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// metadataLease is the service metadata key holding the orchestrator lease.
+const metadataLease = "orchestrator-lease"
+
+var errLostLease = errors.New("orchestrator lease lost")
+
+// lease grants its holder the right to reconcile until it expires. Every new
+// holder gets a greater token, so a former leader can tell it was fenced off.
+type lease struct {
+	Holder  string    `json:"holder"`
+	Token   int64     `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// leaderElector elects a single orchestrator among the replicas of the
+// service through a lease in the service metadata.
+type leaderElector struct {
+	sync.Mutex
+	store metadataStore
+	id    string
+	ttl   time.Duration
+	now   func() time.Time
+
+	// token and expiry of the lease held, token is 0 while standing by
+	token   int64
+	expires time.Time
+}
+
+func newLeaderElector(store metadataStore, id string, ttl time.Duration) *leaderElector {
+	return &leaderElector{
+		store: store,
+		id:    id,
+		ttl:   ttl,
+		now:   time.Now,
+	}
+}
+
+func (e *leaderElector) read() (lease, error) {
+	var l lease
+	v, err := e.store.getMetadata(metadataLease)
+	if err != nil || v == "" {
+		return l, err
+	}
+	err = json.Unmarshal([]byte(v), &l)
+	return l, err
+}
+
+func (e *leaderElector) write(l lease) error {
+	v, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return e.store.putMetadata(metadataLease, string(v))
+}
+
+// campaign renews the lease held, or takes it over once it expired. The
+// metadata can't be updated atomically, so a takeover only counts once the
+// lease reads back with the new token. That isn't mutual exclusion: metadata
+// is last-writer-wins, and two instances taking over an expired lease at the
+// same moment may each read back their own write. The token that check()
+// compares before every step fences off whichever lost as soon as it reads
+// the other's write, but until then both may act.
+func (e *leaderElector) campaign() (bool, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	l, err := e.read()
+	if err != nil {
+		return false, err
+	}
+	now := e.now()
+
+	if e.token != 0 && l.Holder == e.id && l.Token == e.token {
+		l.Expires = now.Add(e.ttl)
+		if err := e.write(l); err != nil {
+			return false, err
+		}
+		e.expires = l.Expires
+		return true, nil
+	}
+
+	if now.Before(l.Expires) {
+		if e.token != 0 {
+			log.WithFields(log.Fields{
+				"holder": l.Holder,
+				"token":  l.Token,
+			}).Warn("Lost the orchestrator lease")
+			e.token = 0
+		}
+		return false, nil
+	}
+
+	next := lease{Holder: e.id, Token: l.Token + 1, Expires: now.Add(e.ttl)}
+	if err := e.write(next); err != nil {
+		return false, err
+	}
+	if l, err = e.read(); err != nil || l.Holder != e.id || l.Token != next.Token {
+		return false, err
+	}
+	e.token = next.Token
+	e.expires = next.Expires
+	log.WithFields(log.Fields{
+		"id":    e.id,
+		"token": e.token,
+	}).Info("Acquired the orchestrator lease")
+	return true, nil
+}
+
+// check fails unless the lease is still held, with the same token. The
+// leader checks it before every change it makes.
+func (e *leaderElector) check() error {
+	l, err := e.read()
+	if err != nil {
+		return err
+	}
+	e.Lock()
+	token := e.token
+	e.Unlock()
+	if token == 0 || l.Holder != e.id || l.Token != token || !e.now().Before(l.Expires) {
+		return errLostLease
+	}
+	return nil
+}
+
+// resign releases the lease held, so that a standby takes over on its next
+// campaign instead of waiting for the lease to expire.
+func (e *leaderElector) resign() error {
+	if e.check() != nil {
+		return nil
+	}
+	e.Lock()
+	defer e.Unlock()
+	l := lease{Holder: e.id, Token: e.token, Expires: e.now()}
+	e.token = 0
+	return e.write(l)
+}
+
+// hold renews the lease every third of its ttl until ctx ends, so that it
+// doesn't expire under a long reconciliation. Once the lease is lost, or
+// renewals kept failing until less than a third of the ttl is left, which is
+// the margin for clock skew between the instances, it calls lost to cancel
+// whatever the lease guards.
+func (e *leaderElector) hold(ctx context.Context, lost func()) {
+	t := time.NewTicker(e.ttl / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		leader, err := e.campaign()
+		if err == nil && leader {
+			continue
+		}
+		if err != nil {
+			e.Lock()
+			expires := e.expires
+			e.Unlock()
+			log.WithField("error", err.Error()).Warn("Failed to renew the orchestrator lease")
+			if e.now().Add(e.ttl / 3).Before(expires) {
+				continue
+			}
+		}
+		log.Warn("Canceling the reconciliation, the orchestrator lease can't be held")
+		lost()
+		return
+	}
+}
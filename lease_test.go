@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeaderElection(t *testing.T) {
+	c := newFakeCluster()
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	a := newLeaderElector(c, "a", time.Minute)
+	b := newLeaderElector(c, "b", time.Minute)
+	a.now, b.now = clock, clock
+
+	campaign := func(e *leaderElector, want bool) {
+		t.Helper()
+		leader, err := e.campaign()
+		if err != nil {
+			t.Fatalf("%s campaign: %v", e.id, err)
+		}
+		if leader != want {
+			t.Fatalf("%s leader = %t, want %t", e.id, leader, want)
+		}
+	}
+
+	campaign(a, true)
+	campaign(b, false)
+	if a.token != 1 || a.check() != nil {
+		t.Fatalf("a should hold token 1, has %d", a.token)
+	}
+
+	// renewals keep the lease
+	now = now.Add(50 * time.Second)
+	campaign(a, true)
+	now = now.Add(50 * time.Second)
+	campaign(b, false)
+
+	// a stops renewing and b takes over within the ttl
+	now = now.Add(time.Minute)
+	campaign(b, true)
+	if b.token != 2 {
+		t.Errorf("b token = %d, want 2", b.token)
+	}
+	if err := a.check(); err != errLostLease {
+		t.Errorf("a check = %v, want %v", err, errLostLease)
+	}
+	campaign(a, false)
+	if a.token != 0 {
+		t.Errorf("a token = %d, want 0", a.token)
+	}
+
+	// resigning hands the lease over right away
+	if err := b.resign(); err != nil {
+		t.Fatalf("resign: %v", err)
+	}
+	campaign(a, true)
+	if a.token != 3 {
+		t.Errorf("a token = %d, want 3", a.token)
+	}
+}
+
+func TestFencing(t *testing.T) {
+	c := newTestCluster([]string{"manager", "inactive", "inactive"}, nil)
+	e := newLeaderElector(c, "a", time.Minute)
+	if leader, err := e.campaign(); err != nil || !leader {
+		t.Fatalf("campaign = %t, %v", leader, err)
+	}
+	// another instance took over in the meantime
+	c.metadata[metadataLease] = `{"holder":"b","token":2,"expires":"2099-01-01T00:00:00Z"}`
+
+	err := newReconciliation(c, c, reconcileOptions{managerCount: 3, fence: e.check}).run(context.Background())
+	if err != errLostLease {
+		t.Errorf("run = %v, want %v", err, errLostLease)
+	}
+	if got := c.count("join"); got != 0 {
+		t.Errorf("join calls = %d, want 0", got)
+	}
+}
+
+// failingMetadata fails every read and write while fail is set.
+type failingMetadata struct {
+	metadataStore
+	sync.Mutex
+	fail bool
+}
+
+func (m *failingMetadata) failing() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.fail
+}
+
+func (m *failingMetadata) getMetadata(key string) (string, error) {
+	if m.failing() {
+		return "", errors.New("metadata unavailable")
+	}
+	return m.metadataStore.getMetadata(key)
+}
+
+func (m *failingMetadata) putMetadata(key, value string) error {
+	if m.failing() {
+		return errors.New("metadata unavailable")
+	}
+	return m.metadataStore.putMetadata(key, value)
+}
+
+func TestLeaseHold(t *testing.T) {
+	const ttl = 60 * time.Millisecond
+
+	hold := func(e *leaderElector) (context.CancelFunc, <-chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		lost := make(chan struct{})
+		go e.hold(ctx, func() { close(lost) })
+		return cancel, lost
+	}
+
+	// renewals keep the lease through a cycle longer than its ttl
+	c := newFakeCluster()
+	e := newLeaderElector(c, "a", ttl)
+	if leader, err := e.campaign(); err != nil || !leader {
+		t.Fatalf("campaign = %t, %v", leader, err)
+	}
+	stop, lost := hold(e)
+	select {
+	case <-lost:
+		t.Fatal("lease lost while renewed")
+	case <-time.After(3 * ttl):
+	}
+	stop()
+	if err := e.check(); err != nil {
+		t.Errorf("check = %v after renewals", err)
+	}
+
+	// a takeover cancels the cycle
+	stop, lost = hold(e)
+	defer stop()
+	c.putMetadata(metadataLease, `{"holder":"b","token":9,"expires":"2099-01-01T00:00:00Z"}`)
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatal("takeover didn't cancel the cycle")
+	}
+
+	// failed renewals cancel the cycle before the lease expires
+	m := &failingMetadata{metadataStore: newFakeCluster()}
+	e = newLeaderElector(m, "a", ttl)
+	if leader, err := e.campaign(); err != nil || !leader {
+		t.Fatalf("campaign = %t, %v", leader, err)
+	}
+	m.Lock()
+	m.fail = true
+	m.Unlock()
+	stop, lost = hold(e)
+	defer stop()
+	select {
+	case <-lost:
+		if !time.Now().Before(e.expires) {
+			t.Error("cycle canceled only once the lease expired")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failed renewals didn't cancel the cycle")
+	}
+}
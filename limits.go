@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+const (
+	defaultWorkers       = 16
+	defaultInfoTimeout   = 10 * time.Second
+	defaultJoinTimeout   = time.Minute
+	defaultUpdateTimeout = 30 * time.Second
+)
+
+// callContext returns the context of a single daemon call, which ends after
+// timeout or with the reconciliation, whichever comes first.
+func (r *Reconcile) callContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(r.ctx)
+	}
+	return context.WithTimeout(r.ctx, timeout)
+}
+
+// forEachHost calls f for every host, running at most workers calls at once,
+// and returns once all of them returned. Hosts that haven't started when the
+// reconciliation is canceled are skipped.
+func (r *Reconcile) forEachHost(hosts []rancher.Host, f func(rancher.Host)) {
+	workers := r.workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	sem := make(chan struct{}, workers)
+
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		select {
+		case sem <- struct{}{}:
+		case <-r.ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+
+		go func(h rancher.Host) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(h)
+		}(h)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+// hangingDialer hands out daemons whose Info blocks until the call is
+// canceled, for the hosts in hung.
+type hangingDialer struct {
+	dialer daemonDialer
+	hung   map[string]bool
+}
+
+type hangingDaemon struct {
+	swarmDaemon
+}
+
+func (d *hangingDialer) connect(ctx context.Context, h rancher.Host) (swarmDaemon, error) {
+	c, err := d.dialer.connect(ctx, h)
+	if err != nil || !d.hung[h.Id] {
+		return c, err
+	}
+	return &hangingDaemon{c}, nil
+}
+
+func (d *hangingDaemon) Info(ctx context.Context) (types.Info, error) {
+	<-ctx.Done()
+	return types.Info{}, ctx.Err()
+}
+
+func TestForEachHost(t *testing.T) {
+	c := newTestCluster([]string{"worker", "worker", "worker", "worker", "worker", "worker"}, nil)
+	r := newReconciliation(c, c, reconcileOptions{workers: 2})
+
+	var mu sync.Mutex
+	running, peak, calls := 0, 0, 0
+	r.forEachHost(c.hosts, func(h rancher.Host) {
+		mu.Lock()
+		running++
+		calls++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	if calls != len(c.hosts) {
+		t.Errorf("%d calls, want %d", calls, len(c.hosts))
+	}
+	if peak != 2 {
+		t.Errorf("%d concurrent calls, want 2", peak)
+	}
+
+	// hosts are skipped once the reconciliation is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	r.ctx = ctx
+	calls = 0
+	r.forEachHost(c.hosts, func(h rancher.Host) {
+		mu.Lock()
+		defer mu.Unlock()
+		if calls++; calls == 2 {
+			cancel()
+		}
+		time.Sleep(10 * time.Millisecond)
+	})
+	if calls >= len(c.hosts) {
+		t.Errorf("%d calls after cancel, want fewer than %d", calls, len(c.hosts))
+	}
+}
+
+func TestDaemonTimeouts(t *testing.T) {
+	c := newTestCluster([]string{"manager", "worker", "worker"}, nil)
+	d := &hangingDialer{dialer: c, hung: map[string]bool{"1h3": true}}
+	opts := reconcileOptions{managerCount: 1, infoTimeout: 20 * time.Millisecond}
+
+	// a hung daemon is unreachable once its call times out
+	r := newReconciliation(c, d, opts)
+	done := make(chan error, 1)
+	go func() { done <- r.run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a hung daemon stalled the reconciliation")
+	}
+	if reason, ok := r.unreachable["1h3"]; !ok || reason != context.DeadlineExceeded.Error() {
+		t.Errorf("unreachable = %v, want 1h3 timed out", r.unreachable)
+	}
+
+	// a canceled reconciliation stops before it acts
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.calls = nil
+	if err := newReconciliation(c, d, opts).run(ctx); err != context.Canceled {
+		t.Errorf("run = %v, want %v", err, context.Canceled)
+	}
+	if len(c.calls) != 0 {
+		t.Errorf("canceled reconciliation made calls %v", c.calls)
+	}
+}
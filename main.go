@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -13,6 +18,183 @@ const (
 	rancherTimeout = 5 * time.Second
 )
 
+var reconcileFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:   "manager-count",
+		Usage:  "maximum number of managers to elect",
+		EnvVar: "MANAGER_COUNT",
+		Value:  5,
+	},
+	cli.DurationFlag{
+		Name:   "pending-timeout",
+		Usage:  "duration a host may stay pending before it is forced to leave the swarm",
+		EnvVar: "PENDING_TIMEOUT",
+		Value:  2 * time.Minute,
+	},
+	cli.StringFlag{
+		Name:   "failure-domain-label",
+		Usage:  "host label (e.g. zone) whose values managers are spread across",
+		EnvVar: "FAILURE_DOMAIN_LABEL",
+	},
+	cli.StringFlag{
+		Name:   "selection-policy",
+		Usage:  "comma separated order in which hosts are picked as managers (demoted in reverse): oldest, resources, label, spread",
+		EnvVar: "SELECTION_POLICY",
+		Value:  "spread,oldest",
+	},
+	cli.StringFlag{
+		Name:   "selection-label",
+		Usage:  "host label, key or key=value, preferred by the label selection policy",
+		EnvVar: "SELECTION_LABEL",
+	},
+	cli.BoolTFlag{
+		Name:   "publish-status",
+		Usage:  "publish the swarm role, state, node, cluster, leader and error of each host in swarm.* host labels",
+		EnvVar: "PUBLISH_STATUS",
+	},
+	cli.StringFlag{
+		Name:   "pause-label",
+		Usage:  "host label that pauses scheduling on the host's swarm node",
+		EnvVar: "PAUSE_LABEL",
+		Value:  "io.rancher.swarmkit.pause",
+	},
+	cli.StringFlag{
+		Name:   "node-label-prefix",
+		Usage:  "copy host labels with this prefix to the host's swarm node",
+		EnvVar: "NODE_LABEL_PREFIX",
+	},
+	cli.StringSliceFlag{
+		Name:   "node-label",
+		Usage:  "copy this host label to the host's swarm node (repeatable, comma separated in NODE_LABELS)",
+		EnvVar: "NODE_LABELS",
+	},
+	cli.DurationFlag{
+		Name:   "drain-timeout",
+		Usage:  "how long a node leaving the swarm may take to drain before it is removed anyway",
+		EnvVar: "DRAIN_TIMEOUT",
+		Value:  5 * time.Minute,
+	},
+	cli.DurationFlag{
+		Name:   "manager-grace-period",
+		Usage:  "how long a manager may be unreachable before it is demoted and removed",
+		EnvVar: "MANAGER_GRACE_PERIOD",
+		Value:  2 * time.Minute,
+	},
+	cli.StringFlag{
+		Name:   "unlock-key",
+		Usage:  "key used to unlock managers of an autolocked swarm, overriding the stored key",
+		EnvVar: "SWARM_UNLOCK_KEY",
+	},
+	cli.BoolFlag{
+		Name:   "autolock",
+		Usage:  "enable swarm autolock and store the unlock key in a Rancher secret",
+		EnvVar: "SWARM_AUTOLOCK",
+	},
+	cli.StringFlag{
+		Name:   "unlock-key-secret",
+		Usage:  "name of the Rancher secret holding the unlock key",
+		EnvVar: "SWARM_UNLOCK_KEY_SECRET",
+		Value:  "swarmkit-unlock-key",
+	},
+	cli.StringFlag{
+		Name:   "join-token-secret",
+		Usage:  "name prefix of the Rancher secrets holding the manager and worker join tokens",
+		EnvVar: "SWARM_JOIN_TOKEN_SECRET",
+		Value:  "swarmkit-join-token",
+	},
+	cli.DurationFlag{
+		Name:   "unlock-key-rotation",
+		Usage:  "rotate the unlock key once it is this old (0 disables rotation)",
+		EnvVar: "SWARM_UNLOCK_KEY_ROTATION",
+	},
+	cli.StringFlag{
+		Name:   "cluster-id",
+		Usage:  "ID of the swarm to manage (defaults to the ID stored in service metadata)",
+		EnvVar: "SWARM_CLUSTER_ID",
+	},
+	cli.StringFlag{
+		Name:   "foreign-cluster-policy",
+		Usage:  "what to do with hosts of another swarm: hold (leave them alone) or rejoin (make them leave and rejoin)",
+		EnvVar: "FOREIGN_CLUSTER_POLICY",
+		Value:  foreignClusterHold,
+	},
+	cli.IntFlag{
+		Name:   "max-unreachable",
+		Usage:  "number of unreachable hosts above which nodes are not demoted, removed or reset",
+		EnvVar: "MAX_UNREACHABLE",
+		Value:  1,
+	},
+	cli.StringFlag{
+		Name:   "service-uuid",
+		Usage:  "UUID of the orchestrator's Rancher service (defaults to the UUID in Rancher metadata)",
+		EnvVar: "SERVICE_UUID",
+	},
+}
+
+var daemonFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "daemon-transport",
+		Usage:  "how to reach Docker daemons: tcp (agent IP, port 2375) or hostaccess (Rancher websocket)",
+		EnvVar: "DAEMON_TRANSPORT",
+		Value:  transportTCP,
+	},
+	cli.IntFlag{
+		Name:   "docker-port",
+		Usage:  "Docker API port for tcp transport (default 2375, or 2376 with TLS)",
+		EnvVar: "DOCKER_PORT",
+	},
+	cli.StringFlag{
+		Name:   "tls-ca",
+		Usage:  "CA used to verify Docker daemon certificates",
+		EnvVar: "DOCKER_TLS_CA",
+	},
+	cli.StringFlag{
+		Name:   "tls-cert",
+		Usage:  "client certificate presented to Docker daemons",
+		EnvVar: "DOCKER_TLS_CERT",
+	},
+	cli.StringFlag{
+		Name:   "tls-key",
+		Usage:  "client private key presented to Docker daemons",
+		EnvVar: "DOCKER_TLS_KEY",
+	},
+	cli.BoolFlag{
+		Name:   "tls-host-secrets",
+		Usage:  "read per-host CA, certificate and key from the Rancher secrets named by host labels",
+		EnvVar: "DOCKER_TLS_HOST_SECRETS",
+	},
+	cli.StringFlag{
+		Name:   "tls-server-name",
+		Usage:  "verify daemon certificates against the host's agent ip or hostname",
+		EnvVar: "DOCKER_TLS_SERVER_NAME",
+		Value:  serverNameIP,
+	},
+	cli.IntFlag{
+		Name:   "daemon-workers",
+		Usage:  "maximum number of Docker daemons called at once",
+		EnvVar: "DAEMON_WORKERS",
+		Value:  defaultWorkers,
+	},
+	cli.DurationFlag{
+		Name:   "info-timeout",
+		Usage:  "timeout of Docker calls that read daemon, node or swarm state (orchestrate caps it at reconcile-period)",
+		EnvVar: "INFO_TIMEOUT",
+		Value:  defaultInfoTimeout,
+	},
+	cli.DurationFlag{
+		Name:   "join-timeout",
+		Usage:  "timeout of Docker calls that init, join, leave or unlock a swarm (orchestrate caps it at reconcile-period)",
+		EnvVar: "JOIN_TIMEOUT",
+		Value:  defaultJoinTimeout,
+	},
+	cli.DurationFlag{
+		Name:   "update-timeout",
+		Usage:  "timeout of Docker calls that update or remove nodes, networks or the swarm (orchestrate caps it at reconcile-period)",
+		EnvVar: "UPDATE_TIMEOUT",
+		Value:  defaultUpdateTimeout,
+	},
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "swarmkit"
@@ -24,41 +206,118 @@ func main() {
 			Aliases: []string{"o"},
 			Usage:   "run the orchestrator",
 			Action:  orchestrate,
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.DurationFlag{
 					Name:   "reconcile-period",
-					Usage:  "duration of time between reconciliations",
+					Usage:  "duration of time between reconciliations, after which a reconciliation still running is canceled",
 					EnvVar: "RECONCILE_PERIOD",
 					Value:  15 * time.Second,
 				},
-				cli.IntFlag{
-					Name:   "manager-count",
-					Usage:  "maximum number of managers to elect",
-					EnvVar: "MANAGER_COUNT",
-					Value:  5,
+				cli.BoolFlag{
+					Name:   "dry-run",
+					Usage:  "log planned actions without changing the swarm",
+					EnvVar: "DRY_RUN",
+				},
+				cli.BoolTFlag{
+					Name:   "watch-events",
+					Usage:  "reconcile on Rancher host changes and swarm node events, not only every reconcile-period",
+					EnvVar: "WATCH_EVENTS",
+				},
+				cli.DurationFlag{
+					Name:   "event-debounce",
+					Usage:  "quiet time after a burst of events before reconciling",
+					EnvVar: "EVENT_DEBOUNCE",
+					Value:  2 * time.Second,
+				},
+				cli.BoolFlag{
+					Name:   "leader-election",
+					Usage:  "elect a single reconciling instance among the replicas of the service",
+					EnvVar: "LEADER_ELECTION",
+				},
+				cli.DurationFlag{
+					Name:   "lease-ttl",
+					Usage:  "how long the leader's lease lasts without renewal, which bounds how long a failover takes",
+					EnvVar: "LEASE_TTL",
+					Value:  time.Minute,
+				},
+				cli.StringFlag{
+					Name:   "instance-id",
+					Usage:  "name of this instance in leader election (defaults to the hostname)",
+					EnvVar: "INSTANCE_ID",
+					Value:  hostname(),
+				},
+				cli.DurationFlag{
+					Name:   "daemon-check-interval",
+					Usage:  "how long a pooled Docker daemon connection is reused before it is health-checked again",
+					EnvVar: "DAEMON_CHECK_INTERVAL",
+					Value:  time.Minute,
+				},
+			}, append(reconcileFlags, daemonFlags...)...),
+		},
+		{
+			Name:   "plan",
+			Usage:  "print the actions the orchestrator would take and exit",
+			Action: printPlan,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "output format: text or json",
+					Value: "text",
+				},
+			}, append(reconcileFlags, daemonFlags...)...),
+		},
+		{
+			Name:   "import",
+			Usage:  "adopt an existing swarm: record its cluster ID and join tokens and label its managers",
+			Action: importCluster,
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the adoption steps without executing them",
+				},
+			}, append(reconcileFlags, daemonFlags...)...),
+		},
+		{
+			Name:    "proxy",
+			Aliases: []string{"p"},
+			Usage:   "proxy the local Docker API through Rancher host access",
+			Action:  proxy,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "bind",
+					Usage:  "address to listen on (unix:///path, or tcp://host:port which requires tls-cert, tls-key and tls-ca unless it is loopback)",
+					EnvVar: "PROXY_BIND",
+					Value:  "unix:///var/run/swarmkit/docker.sock",
+				},
+				cli.StringFlag{
+					Name:   "host",
+					Usage:  "Rancher host id, uuid, name or hostname to proxy (defaults to the local hostname)",
+					EnvVar: "PROXY_HOST",
+				},
+				cli.StringFlag{
+					Name:   "tls-cert",
+					Usage:  "server certificate for tcp listeners",
+					EnvVar: "PROXY_TLS_CERT",
+				},
+				cli.StringFlag{
+					Name:   "tls-key",
+					Usage:  "server private key for tcp listeners",
+					EnvVar: "PROXY_TLS_KEY",
+				},
+				cli.StringFlag{
+					Name:   "tls-ca",
+					Usage:  "CA used to verify client certificates",
+					EnvVar: "PROXY_TLS_CA",
 				},
 			},
 		},
 	}
-	app.Run(os.Args)
+	if err := app.Run(os.Args); err != nil {
+		os.Exit(1)
+	}
 }
 
 func orchestrate(c *cli.Context) error {
-	managerCount := c.Int("manager-count")
-	switch {
-	case managerCount <= 0:
-		managerCount = 3
-	case managerCount == 1:
-		log.Warnf("manager-count (%d) is a single point of failure", managerCount)
-	case managerCount > 9:
-		managerCount = 9
-	case managerCount%2 == 0:
-		managerCount += 1
-	}
-	if managerCount != c.Int("manager-count") {
-		log.Warnf("invalid manager-count (%d) was overridden (%d)", c.Int("manager-count"), managerCount)
-	}
-
 	reconcilePeriod := c.Duration("reconcile-period")
 	switch {
 	case reconcilePeriod < 1*time.Second:
@@ -71,17 +330,297 @@ func orchestrate(c *cli.Context) error {
 	}
 
 	client := newRancherClient()
+	connector, err := newDaemonConnectorFromContext(c, client)
+	if err != nil {
+		return err
+	}
+	// keep daemon connections open from one reconciliation to the next
+	daemons := newDaemonPool(connector, c.Duration("daemon-check-interval"))
+
+	opts, err := newReconcileOptions(c, client)
+	if err != nil {
+		return err
+	}
+	opts.dryRun = c.Bool("dry-run")
+	opts.tracker = newHostTracker()
+	// a cycle is canceled once the next one is due, so no daemon call may
+	// outlast it
+	for _, t := range []struct {
+		name    string
+		timeout *time.Duration
+	}{
+		{"info-timeout", &opts.infoTimeout},
+		{"join-timeout", &opts.joinTimeout},
+		{"update-timeout", &opts.updateTimeout},
+	} {
+		if *t.timeout <= reconcilePeriod {
+			continue
+		}
+		if c.IsSet(t.name) {
+			log.Warnf("%s (%v) exceeds the reconcile-period and was overridden (%v)", t.name, *t.timeout, reconcilePeriod)
+		}
+		*t.timeout = reconcilePeriod
+	}
+	if opts.dryRun {
+		log.Info("Dry run: planned actions will be logged but not executed")
+	}
+
+	var elector *leaderElector
+	if c.Bool("leader-election") {
+		if opts.metadata == nil {
+			return errors.New("Leader election needs the service metadata, set --service-uuid")
+		}
+		ttl := c.Duration("lease-ttl")
+		if ttl < 2*reconcilePeriod {
+			ttl = 3 * reconcilePeriod
+			log.Warnf("lease-ttl (%v) must exceed two reconcile periods and was overridden (%v)", c.Duration("lease-ttl"), ttl)
+		}
+		if c.String("instance-id") == "" {
+			return errors.New("Leader election needs an instance ID, set --instance-id")
+		}
+		elector = newLeaderElector(opts.metadata, c.String("instance-id"), ttl)
+	}
+
+	// steps stop once shutdown began or the lease was lost
+	s := handleSignals()
+	opts.fence = func() error {
+		if err := s.fence(); err != nil {
+			return err
+		}
+		if elector != nil {
+			return elector.check()
+		}
+		return nil
+	}
+
+	inventory := &rancherInventory{client}
+	var triggers <-chan struct{}
+	if c.BoolT("watch-events") {
+		d := newDebouncer(c.Duration("event-debounce"))
+		triggers = d.trigger
+		go watchRancher(s.stopping, client, d.notify)
+		go watchDocker(s.stopping, inventory, daemons, opts.infoTimeout, d.notify)
+	}
+
 	t := time.NewTicker(reconcilePeriod)
+	defer t.Stop()
+
+	for {
+		// events trigger reconciliations early, the ticker resyncs anyway
+		select {
+		case <-t.C:
+		case <-triggers:
+		case <-s.stopping.Done():
+		}
+		if s.stopping.Err() != nil {
+			break
+		}
+
+		if elector != nil {
+			leader, err := elector.campaign()
+			if err != nil {
+				log.WithField("error", err.Error()).Warn("Failed to campaign for the orchestrator lease")
+				continue
+			}
+			if !leader {
+				continue
+			}
+		}
 
-	for _ = range t.C {
-		if err := newReconciliation(client, managerCount).run(); err != nil {
+		// the cycle is canceled once the next one is due
+		ctx, cancel := context.WithTimeout(s.aborting, reconcilePeriod)
+		if elector != nil {
+			// the lease must outlast the cycle, or a standby could take
+			// over while a step is in flight
+			go elector.hold(ctx, cancel)
+		}
+		err := newReconciliation(inventory, daemons, opts).run(ctx)
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			log.Warnf("Reconciliation was canceled after %v", reconcilePeriod)
+		case err == errShuttingDown, ctx.Err() != nil:
+		case err != nil:
 			log.Error(err)
 		}
+		cancel()
+	}
+
+	daemons.close()
+	if elector != nil {
+		if err := elector.resign(); err != nil {
+			log.WithField("error", err.Error()).Warn("Failed to release the orchestrator lease")
+			return err
+		}
+		log.Info("Released the orchestrator lease")
+	}
+	log.Info("Orchestrator stopped")
+	return s.err()
+}
+
+func printPlan(c *cli.Context) error {
+	format := c.String("format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format: %s", format)
+	}
+
+	client := newRancherClient()
+	daemons, err := newDaemonConnectorFromContext(c, client)
+	if err != nil {
+		return err
 	}
 
+	opts, err := newReconcileOptions(c, client)
+	if err != nil {
+		return err
+	}
+	opts.dryRun = true
+	r := newReconciliation(&rancherInventory{client}, daemons, opts)
+	if err := r.run(context.Background()); err != nil {
+		return err
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r.plan)
+	}
+
+	if len(r.plan.Steps) == 0 {
+		fmt.Println("No changes")
+	} else {
+		fmt.Printf("Decision: %s\n", r.plan.Decision)
+		for i, step := range r.plan.Steps {
+			fmt.Printf("%d. %s\n", i+1, step)
+		}
+	}
+	if len(r.plan.Unreachable) > 0 {
+		fmt.Println("Unreachable hosts:")
+		for _, h := range r.registeredHosts {
+			if reason, ok := r.plan.Unreachable[h.Id]; ok {
+				fmt.Printf("  %s (%s): %s\n", h.Id, h.Hostname, reason)
+			}
+		}
+	}
+	return nil
+}
+
+func importCluster(c *cli.Context) error {
+	client := newRancherClient()
+	daemons, err := newDaemonConnectorFromContext(c, client)
+	if err != nil {
+		return err
+	}
+
+	opts, err := newReconcileOptions(c, client)
+	if err != nil {
+		return err
+	}
+	if opts.metadata == nil {
+		return errors.New("Service metadata is required to import a swarm, set --service-uuid")
+	}
+	opts.adoptOnly = true
+	opts.dryRun = c.Bool("dry-run")
+	r := newReconciliation(&rancherInventory{client}, daemons, opts)
+	if err := r.run(context.Background()); err != nil {
+		return err
+	}
+
+	for i, step := range r.plan.Steps {
+		fmt.Printf("%d. %s\n", i+1, step)
+	}
+	if !opts.dryRun {
+		fmt.Printf("Imported swarm %s\n", r.expectedCluster)
+	}
 	return nil
 }
 
+func newReconcileOptions(c *cli.Context, client *rancher.RancherClient) (reconcileOptions, error) {
+	opts := reconcileOptions{
+		managerCount:         getManagerCount(c),
+		pendingTimeout:       c.Duration("pending-timeout"),
+		managerGracePeriod:   c.Duration("manager-grace-period"),
+		drainTimeout:         c.Duration("drain-timeout"),
+		failureDomainLabel:   c.String("failure-domain-label"),
+		publishStatus:        c.BoolT("publish-status"),
+		selectionLabel:       c.String("selection-label"),
+		pauseLabel:           c.String("pause-label"),
+		nodeLabelPrefix:      c.String("node-label-prefix"),
+		nodeLabels:           c.StringSlice("node-label"),
+		unlockKey:            c.String("unlock-key"),
+		autolock:             c.Bool("autolock"),
+		unlockKeySecret:      c.String("unlock-key-secret"),
+		unlockKeyRotation:    c.Duration("unlock-key-rotation"),
+		secrets:              &rancherSecrets{client},
+		joinTokenSecret:      c.String("join-token-secret"),
+		clusterID:            c.String("cluster-id"),
+		foreignClusterPolicy: c.String("foreign-cluster-policy"),
+		maxUnreachable:       c.Int("max-unreachable"),
+		workers:              c.Int("daemon-workers"),
+		infoTimeout:          c.Duration("info-timeout"),
+		joinTimeout:          c.Duration("join-timeout"),
+		updateTimeout:        c.Duration("update-timeout"),
+	}
+	if opts.workers <= 0 {
+		opts.workers = defaultWorkers
+		log.Warnf("invalid daemon-workers (%d) was overridden (%d)", c.Int("daemon-workers"), opts.workers)
+	}
+
+	for _, p := range strings.Split(c.String("selection-policy"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			opts.selectionPolicy = append(opts.selectionPolicy, p)
+		}
+	}
+	if err := validSelectionPolicy(opts.selectionPolicy); err != nil {
+		return opts, err
+	}
+
+	switch opts.foreignClusterPolicy {
+	case foreignClusterHold, foreignClusterRejoin:
+	default:
+		return opts, fmt.Errorf("unknown foreign-cluster-policy: %s", opts.foreignClusterPolicy)
+	}
+
+	if metadata, err := newServiceMetadata(client, c.String("service-uuid")); err != nil {
+		log.WithField("error", err.Error()).Warn("Service metadata unavailable, the cluster ID won't be persisted")
+	} else {
+		opts.metadata = metadata
+	}
+
+	return opts, nil
+}
+
+func getManagerCount(c *cli.Context) int {
+	managerCount := c.Int("manager-count")
+	switch {
+	case managerCount <= 0:
+		managerCount = 3
+	case managerCount == 1:
+		log.Warnf("manager-count (%d) is a single point of failure", managerCount)
+	case managerCount > 9:
+		managerCount = 9
+	case managerCount%2 == 0:
+		managerCount += 1
+	}
+	if managerCount != c.Int("manager-count") {
+		log.Warnf("invalid manager-count (%d) was overridden (%d)", c.Int("manager-count"), managerCount)
+	}
+	return managerCount
+}
+
+func newDaemonConnectorFromContext(c *cli.Context, client *rancher.RancherClient) (*daemonConnector, error) {
+	daemonTLS, err := loadDaemonTLS(c.String("tls-ca"), c.String("tls-cert"), c.String("tls-key"),
+		c.Bool("tls-host-secrets"), c.String("tls-server-name"))
+	if err != nil {
+		return nil, err
+	}
+	return newDaemonConnector(client, c.String("daemon-transport"), c.Int("docker-port"), daemonTLS)
+}
+
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
+
 func getenv(key string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+const (
+	metadataURL = "http://rancher-metadata.rancher.internal/2015-12-19"
+
+	// service metadata keys
+	metadataClusterID = "swarm-cluster-id"
+)
+
+// metadataStore reads and writes string values that must survive restarts of
+// the orchestrator. A missing key reads as "".
+type metadataStore interface {
+	getMetadata(key string) (string, error)
+	putMetadata(key, value string) error
+}
+
+// serviceMetadata keeps values in the metadata of the orchestrator's own
+// Rancher service. Rancher only updates the metadata as a whole, so writes
+// are serialized: the lease is renewed while a reconciliation records the
+// cluster, and either write would otherwise undo the other.
+type serviceMetadata struct {
+	sync.Mutex
+	services rancher.ServiceOperations
+	uuid     string
+}
+
+// newServiceMetadata looks up the orchestrator's service UUID from Rancher
+// metadata unless one is given.
+func newServiceMetadata(c *rancher.RancherClient, uuid string) (*serviceMetadata, error) {
+	if uuid == "" {
+		resp, err := (&http.Client{Timeout: rancherTimeout}).Get(metadataURL + "/self/service/uuid")
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to read service uuid from metadata: %s", resp.Status)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		uuid = strings.TrimSpace(string(b))
+	}
+	return &serviceMetadata{
+		services: c.Service,
+		uuid:     uuid,
+	}, nil
+}
+
+func (m *serviceMetadata) service() (*rancher.Service, error) {
+	services, err := m.services.List(&rancher.ListOpts{
+		Filters: map[string]interface{}{
+			"uuid": m.uuid,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(services.Data) == 0 {
+		return nil, fmt.Errorf("service not found: %s", m.uuid)
+	}
+	return &services.Data[0], nil
+}
+
+func (m *serviceMetadata) getMetadata(key string) (string, error) {
+	s, err := m.service()
+	if err != nil {
+		return "", err
+	}
+	value, _ := s.Metadata[key].(string)
+	return value, nil
+}
+
+func (m *serviceMetadata) putMetadata(key, value string) error {
+	m.Lock()
+	defer m.Unlock()
+	s, err := m.service()
+	if err != nil {
+		return err
+	}
+	metadata := make(map[string]interface{})
+	for k, v := range s.Metadata {
+		metadata[k] = v
+	}
+	metadata[key] = value
+	_, err = m.services.Update(s, map[string]interface{}{
+		"metadata": metadata,
+	})
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+// fakeServices is a Rancher service API holding a single service, whose
+// updates take a while to land like they do over the network.
+type fakeServices struct {
+	rancher.ServiceOperations
+	sync.Mutex
+	service rancher.Service
+}
+
+func (s *fakeServices) List(opts *rancher.ListOpts) (*rancher.ServiceCollection, error) {
+	s.Lock()
+	defer s.Unlock()
+	service := s.service
+	service.Metadata = make(map[string]interface{})
+	for k, v := range s.service.Metadata {
+		service.Metadata[k] = v
+	}
+	return &rancher.ServiceCollection{Data: []rancher.Service{service}}, nil
+}
+
+func (s *fakeServices) Update(existing *rancher.Service, updates interface{}) (*rancher.Service, error) {
+	time.Sleep(time.Millisecond)
+	s.Lock()
+	defer s.Unlock()
+	s.service.Metadata = updates.(map[string]interface{})["metadata"].(map[string]interface{})
+	return &s.service, nil
+}
+
+func TestServiceMetadataConcurrentWrites(t *testing.T) {
+	const ttl = 15 * time.Millisecond
+	m := &serviceMetadata{
+		services: &fakeServices{service: rancher.Service{Uuid: "uuid"}},
+		uuid:     "uuid",
+	}
+	e := newLeaderElector(m, "a", ttl)
+	if leader, err := e.campaign(); err != nil || !leader {
+		t.Fatalf("campaign = %t, %v", leader, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lost := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		e.hold(ctx, func() { close(lost) })
+		close(done)
+	}()
+
+	// the lease is renewed while the cluster ID is pinned over and over
+	c := newTestCluster([]string{"manager"}, nil)
+	r := newReconciliation(c, c, reconcileOptions{metadata: m})
+	var id string
+	for i := 0; i < 50; i++ {
+		id = fmt.Sprintf("cluster-%d", i)
+		if err := r.pinClusterID(id); err != nil {
+			t.Fatalf("pin: %v", err)
+		}
+	}
+	cancel()
+	<-done
+
+	select {
+	case <-lost:
+		t.Fatal("a pinned cluster ID overwrote a lease renewal")
+	default:
+	}
+	if err := e.check(); err != nil {
+		t.Errorf("check = %v", err)
+	}
+	if got, _ := m.getMetadata(metadataClusterID); got != id {
+		t.Errorf("cluster ID = %q, want %q", got, id)
+	}
+}
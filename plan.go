@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+type StepAction string
+
+const (
+	StepInit          StepAction = "init"
+	StepCreateNetwork StepAction = "create-network"
+	StepJoinManager   StepAction = "join-manager"
+	StepJoinWorker    StepAction = "join-worker"
+	StepPromote       StepAction = "promote"
+	StepDemote        StepAction = "demote"
+	StepDrain         StepAction = "drain"
+	StepRemove        StepAction = "remove"
+	StepLeave         StepAction = "leave"
+	StepUnlock        StepAction = "unlock"
+	StepPinCluster    StepAction = "pin-cluster"
+
+	StepRecordJoinTokens StepAction = "record-join-tokens"
+	StepLabelManager     StepAction = "label-manager"
+	StepLabelNode        StepAction = "label-node"
+	StepSetAvailability  StepAction = "set-availability"
+	StepHostStatus       StepAction = "host-status"
+
+	StepEnableAutolock  StepAction = "enable-autolock"
+	StepStoreUnlockKey  StepAction = "store-unlock-key"
+	StepRotateUnlockKey StepAction = "rotate-unlock-key"
+)
+
+// remediation reports whether the action repairs a single unhealthy host, in
+// which case its failure doesn't stop the rest of the plan.
+func (a StepAction) remediation() bool {
+	return a == StepLeave || a == StepUnlock
+}
+
+// destructive reports whether the action drains, demotes, removes or resets a
+// node, which is held back while too many hosts are unreachable.
+func (a StepAction) destructive() bool {
+	switch a {
+	case StepInit, StepDrain, StepDemote, StepRemove, StepLeave:
+		return true
+	}
+	return false
+}
+
+// Step is a single concrete change to the swarm. Host steps identify the
+// Rancher host, node steps identify the swarm node (and the host, if known).
+type Step struct {
+	Action    StepAction        `json:"action"`
+	HostID    string            `json:"hostId,omitempty"`
+	Address   string            `json:"address,omitempty"`
+	NodeID    string            `json:"nodeId,omitempty"`
+	Network   string            `json:"network,omitempty"`
+	ClusterID string            `json:"clusterId,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Force     bool              `json:"force,omitempty"`
+
+	RemoveLabels []string               `json:"removeLabels,omitempty"`
+	Availability swarm.NodeAvailability `json:"availability,omitempty"`
+}
+
+func (s Step) String() string {
+	switch s.Action {
+	case StepInit:
+		return fmt.Sprintf("init swarm on host %s (%s)", s.HostID, s.Address)
+	case StepCreateNetwork:
+		return fmt.Sprintf("create network %s", s.Network)
+	case StepJoinManager:
+		return fmt.Sprintf("join host %s (%s) as manager", s.HostID, s.Address)
+	case StepJoinWorker:
+		return fmt.Sprintf("join host %s (%s) as worker", s.HostID, s.Address)
+	case StepPromote:
+		return fmt.Sprintf("promote node %s (host %s)", s.NodeID, s.HostID)
+	case StepDemote:
+		if s.HostID == "" {
+			return fmt.Sprintf("demote node %s", s.NodeID)
+		}
+		return fmt.Sprintf("demote node %s (host %s)", s.NodeID, s.HostID)
+	case StepDrain:
+		return fmt.Sprintf("drain node %s", s.NodeID)
+	case StepSetAvailability:
+		return fmt.Sprintf("set availability of node %s (host %s) to %s", s.NodeID, s.HostID, s.Availability)
+	case StepLeave:
+		if s.Force {
+			return fmt.Sprintf("force host %s (%s) to leave the swarm", s.HostID, s.Address)
+		}
+		return fmt.Sprintf("host %s (%s) leaves the swarm", s.HostID, s.Address)
+	case StepUnlock:
+		return fmt.Sprintf("unlock manager on host %s (%s)", s.HostID, s.Address)
+	case StepPinCluster:
+		return fmt.Sprintf("pin cluster %s", s.ClusterID)
+	case StepRecordJoinTokens:
+		return fmt.Sprintf("record join tokens of cluster %s", s.ClusterID)
+	case StepLabelManager:
+		return fmt.Sprintf("label host %s (%s) as manager", s.HostID, s.Address)
+	case StepLabelNode:
+		return fmt.Sprintf("label node %s (host %s) %s", s.NodeID, s.HostID, s.labels())
+	case StepHostStatus:
+		return fmt.Sprintf("publish status of host %s (%s) %s", s.HostID, s.Address, s.labels())
+	case StepEnableAutolock:
+		return "enable autolock"
+	case StepStoreUnlockKey:
+		return "store unlock key"
+	case StepRotateUnlockKey:
+		return "rotate unlock key"
+	case StepRemove:
+		if s.Force {
+			return fmt.Sprintf("force remove node %s", s.NodeID)
+		}
+		return fmt.Sprintf("remove node %s", s.NodeID)
+	}
+	return string(s.Action)
+}
+
+// applyLabels sets and removes the step's labels on a node spec.
+func (s Step) applyLabels(spec *swarm.NodeSpec) {
+	if spec.Labels == nil {
+		spec.Labels = make(map[string]string)
+	}
+	for k, v := range s.Labels {
+		spec.Labels[k] = v
+	}
+	for _, k := range s.RemoveLabels {
+		delete(spec.Labels, k)
+	}
+}
+
+// labels formats the labels a step sets as key=value and those it removes
+// as key-.
+func (s Step) labels() string {
+	labels := make([]string, 0, len(s.Labels)+len(s.RemoveLabels))
+	for k, v := range s.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	for _, k := range s.RemoveLabels {
+		labels = append(labels, k+"-")
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+// Plan is the outcome of analyze(): the decision that was reached and the
+// steps act() executes, in order, to carry it out. Unreachable lists the hosts
+// that were left out, keyed by host ID, with the reason.
+type Plan struct {
+	Decision    string            `json:"decision"`
+	Steps       []Step            `json:"steps"`
+	Unreachable map[string]string `json:"unreachable,omitempty"`
+}
+
+func (p *Plan) add(s Step) {
+	p.Steps = append(p.Steps, s)
+}
+
+func (p Plan) String() string {
+	if len(p.Steps) == 0 {
+		return "no changes"
+	}
+	steps := make([]string, len(p.Steps))
+	for i, s := range p.Steps {
+		steps[i] = s.String()
+	}
+	return fmt.Sprintf("%s: %s", p.Decision, strings.Join(steps, "; "))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPlanJSON(t *testing.T) {
+	p := Plan{
+		Decision: "remove-nodes",
+		Steps: []Step{
+			{Action: StepDemote, NodeID: "node1"},
+			{Action: StepRemove, NodeID: "node1", Force: true},
+		},
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Plan
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("round trip = %+v, want %+v", got, p)
+	}
+}
+
+func TestPlanString(t *testing.T) {
+	tests := []struct {
+		plan Plan
+		want string
+	}{
+		{Plan{}, "no changes"},
+		{
+			Plan{
+				Decision: "new",
+				Steps: []Step{
+					{Action: StepInit, HostID: "1h1", Address: "10.0.0.1"},
+					{Action: StepCreateNetwork, Network: "rancher"},
+				},
+			},
+			"new: init swarm on host 1h1 (10.0.0.1); create network rancher",
+		},
+		{
+			Plan{
+				Decision: "remove-nodes",
+				Steps:    []Step{{Action: StepRemove, NodeID: "node1", Force: true}},
+			},
+			"remove-nodes: force remove node node1",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.plan.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+// daemonCache is implemented by dialers that keep state about hosts across
+// reconciliation cycles.
+type daemonCache interface {
+	// evict drops whatever is kept for the host, so that the next connection
+	// starts afresh.
+	evict(id string)
+	// retain drops whatever is kept for hosts that are not in hosts.
+	retain(hosts []rancher.Host)
+}
+
+// daemonPool keeps one client per host, keyed by host ID, across
+// reconciliation cycles instead of dialing every daemon on each one. A client
+// is dialed again when the host's agent IP changes, or when it fails a health
+// check; it is closed once the host is gone.
+type daemonPool struct {
+	sync.Mutex
+	dialer daemonDialer
+	// checkInterval is how long a client is trusted before it's pinged again
+	checkInterval time.Duration
+	now           func() time.Time
+	clients       map[string]*pooledDaemon
+}
+
+// pooledDaemon is a client owned by the pool. Closing it leaves the
+// connection open for the next reconciliation.
+type pooledDaemon struct {
+	swarmDaemon
+	address string
+	checked time.Time
+}
+
+func (p *pooledDaemon) Close() error {
+	return nil
+}
+
+func newDaemonPool(d daemonDialer, checkInterval time.Duration) *daemonPool {
+	return &daemonPool{
+		dialer:        d,
+		checkInterval: checkInterval,
+		now:           time.Now,
+		clients:       make(map[string]*pooledDaemon),
+	}
+}
+
+func (p *daemonPool) connect(ctx context.Context, h rancher.Host) (swarmDaemon, error) {
+	if c := p.get(ctx, h); c != nil {
+		return c, nil
+	}
+
+	d, err := p.dialer.connect(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	c := &pooledDaemon{
+		swarmDaemon: d,
+		address:     h.AgentIpAddress,
+		checked:     p.now(),
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if old, ok := p.clients[h.Id]; ok {
+		// lost a race with another connection to the same host
+		old.swarmDaemon.Close()
+	}
+	p.clients[h.Id] = c
+	return c, nil
+}
+
+// get returns the pooled client of the host, or nil if there is none or it no
+// longer fits the host.
+func (p *daemonPool) get(ctx context.Context, h rancher.Host) *pooledDaemon {
+	p.Lock()
+	c, ok := p.clients[h.Id]
+	p.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if c.address != h.AgentIpAddress {
+		log.WithFields(log.Fields{
+			"id":       h.Id,
+			"previous": c.address,
+			"address":  h.AgentIpAddress,
+		}).Info("Host address changed, reconnecting")
+		p.evict(h.Id)
+		return nil
+	}
+
+	now := p.now()
+	p.Lock()
+	due := now.Sub(c.checked) >= p.checkInterval
+	p.Unlock()
+	if !due {
+		return c
+	}
+
+	if _, err := c.Ping(ctx); err != nil {
+		log.WithFields(log.Fields{
+			"id":     h.Id,
+			"reason": err.Error(),
+		}).Info("Daemon connection failed its health check, reconnecting")
+		p.evict(h.Id)
+		return nil
+	}
+	p.Lock()
+	c.checked = now
+	p.Unlock()
+	return c
+}
+
+// evict closes and forgets the host's client.
+func (p *daemonPool) evict(id string) {
+	p.Lock()
+	c, ok := p.clients[id]
+	delete(p.clients, id)
+	p.Unlock()
+
+	if ok {
+		c.swarmDaemon.Close()
+	}
+	if d, ok := p.dialer.(daemonCache); ok {
+		d.evict(id)
+	}
+}
+
+// retain closes and forgets the clients of hosts that are no longer
+// registered.
+func (p *daemonPool) retain(hosts []rancher.Host) {
+	ids := hostIDs(hosts)
+
+	p.Lock()
+	var gone []string
+	for id := range p.clients {
+		if !ids[id] {
+			gone = append(gone, id)
+		}
+	}
+	p.Unlock()
+
+	for _, id := range gone {
+		p.evict(id)
+	}
+	if d, ok := p.dialer.(daemonCache); ok {
+		d.retain(hosts)
+	}
+}
+
+// close closes every pooled client.
+func (p *daemonPool) close() {
+	p.retain(nil)
+}
+
+func hostIDs(hosts []rancher.Host) map[string]bool {
+	ids := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		ids[h.Id] = true
+	}
+	return ids
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+// countingDialer counts the connections dialed to, and closed on, each host.
+// Daemons of hosts in down fail their health check.
+type countingDialer struct {
+	sync.Mutex
+	dialer  daemonDialer
+	dials   map[string]int
+	closes  map[string]int
+	down    map[string]bool
+	evicted []string
+}
+
+type countedDaemon struct {
+	swarmDaemon
+	dialer *countingDialer
+	id     string
+}
+
+func newCountingDialer(d daemonDialer) *countingDialer {
+	return &countingDialer{
+		dialer: d,
+		dials:  make(map[string]int),
+		closes: make(map[string]int),
+		down:   make(map[string]bool),
+	}
+}
+
+func (c *countingDialer) connect(ctx context.Context, h rancher.Host) (swarmDaemon, error) {
+	d, err := c.dialer.connect(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.dials[h.Id]++
+	return &countedDaemon{swarmDaemon: d, dialer: c, id: h.Id}, nil
+}
+
+func (c *countingDialer) evict(id string) {
+	c.Lock()
+	defer c.Unlock()
+	c.evicted = append(c.evicted, id)
+}
+
+func (c *countingDialer) retain(hosts []rancher.Host) {}
+
+func (d *countedDaemon) Ping(ctx context.Context) (types.Ping, error) {
+	d.dialer.Lock()
+	defer d.dialer.Unlock()
+	if d.dialer.down[d.id] {
+		return types.Ping{}, errors.New("connection reset")
+	}
+	return d.swarmDaemon.Ping(ctx)
+}
+
+func (d *countedDaemon) Close() error {
+	d.dialer.Lock()
+	defer d.dialer.Unlock()
+	d.dialer.closes[d.id]++
+	return nil
+}
+
+func TestDaemonPool(t *testing.T) {
+	c := newTestCluster([]string{"manager", "worker", "worker"}, nil)
+	dialer := newCountingDialer(c)
+	pool := newDaemonPool(dialer, time.Minute)
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	expect := func(id string, dials, closes int) {
+		t.Helper()
+		dialer.Lock()
+		defer dialer.Unlock()
+		if dialer.dials[id] != dials || dialer.closes[id] != closes {
+			t.Errorf("host %s: %d dials and %d closes, want %d and %d",
+				id, dialer.dials[id], dialer.closes[id], dials, closes)
+		}
+	}
+	reconcile := func() {
+		t.Helper()
+		if err := newReconciliation(c, pool, reconcileOptions{managerCount: 1}).run(context.Background()); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	// clients outlive a reconciliation
+	reconcile()
+	reconcile()
+	for _, h := range c.hosts {
+		expect(h.Id, 1, 0)
+	}
+
+	// a changed address dials the host again
+	c.Lock()
+	c.hosts[1].AgentIpAddress = "10.0.1.2"
+	c.Unlock()
+	reconcile()
+	expect("1h2", 2, 1)
+
+	// a failed health check dials the host again, once the interval is up
+	dialer.Lock()
+	dialer.down["1h3"] = true
+	dialer.Unlock()
+	reconcile()
+	expect("1h3", 1, 0)
+	now = now.Add(time.Minute)
+	reconcile()
+	expect("1h3", 2, 1)
+
+	// a removed host is closed and its negotiated version forgotten
+	c.Lock()
+	c.hosts = c.hosts[:2]
+	c.Unlock()
+	reconcile()
+	expect("1h3", 2, 2)
+	if _, ok := pool.clients["1h3"]; ok {
+		t.Error("removed host is still pooled")
+	}
+	want := []string{"1h2", "1h3", "1h3"}
+	if len(dialer.evicted) != len(want) {
+		t.Fatalf("evicted %v, want %v", dialer.evicted, want)
+	}
+	for i := range want {
+		if dialer.evicted[i] != want[i] {
+			t.Errorf("evicted %v, want %v", dialer.evicted, want)
+		}
+	}
+}
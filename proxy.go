@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	dockerapiproxy "github.com/rancher/rancher-docker-api-proxy"
+	"github.com/urfave/cli"
+)
+
+func proxy(c *cli.Context) error {
+	host := c.String("host")
+	if host == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		host = h
+	}
+
+	bind := c.String("bind")
+	if bind == "" {
+		return errors.New("missing bind address")
+	}
+	mutualTLS := c.String("tls-cert") != "" && c.String("tls-key") != "" && c.String("tls-ca") != ""
+	if err := checkProxyBind(bind, mutualTLS); err != nil {
+		return err
+	}
+	if strings.HasPrefix(bind, "unix://") {
+		if err := os.MkdirAll(filepath.Dir(strings.TrimPrefix(bind, "unix://")), 0700); err != nil {
+			return err
+		}
+	}
+
+	p := dockerapiproxy.NewProxy(newRancherClient(), host, bind)
+
+	tlsConfig, err := newProxyTLSConfig(c.String("tls-cert"), c.String("tls-key"), c.String("tls-ca"))
+	if err != nil {
+		return err
+	}
+	p.TlsConfig = tlsConfig
+
+	log.WithFields(log.Fields{
+		"host": host,
+		"bind": bind,
+		"tls":  tlsConfig != nil,
+	}).Info("Starting Docker API proxy")
+
+	return p.ListenAndServe()
+}
+
+// checkProxyBind refuses to serve the Docker API on a tcp address other than
+// loopback unless clients are authenticated with certificates, since anyone
+// reaching the proxy controls the host.
+func checkProxyBind(bind string, mutualTLS bool) error {
+	proto, address := "tcp", bind
+	if parts := strings.SplitN(bind, "://", 2); len(parts) == 2 {
+		proto, address = parts[0], parts[1]
+	}
+	if proto != "tcp" || mutualTLS {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid bind address %s: %v", bind, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("refusing to bind %s without tls-cert, tls-key and tls-ca", bind)
+}
+
+// newProxyTLSConfig returns nil if no certificate was configured. If a CA is
+// given, clients must present a certificate signed by it.
+func newProxyTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, errors.New("tls-ca requires tls-cert and tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls-cert and tls-key must be specified together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
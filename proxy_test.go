@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestCheckProxyBind(t *testing.T) {
+	for _, test := range []struct {
+		bind      string
+		mutualTLS bool
+		ok        bool
+	}{
+		{"unix:///var/run/swarmkit/docker.sock", false, true},
+		{"tcp://127.0.0.1:2375", false, true},
+		{"tcp://localhost:2375", false, true},
+		{"tcp://[::1]:2375", false, true},
+		{"127.0.0.1:2375", false, true},
+		{"tcp://0.0.0.0:2375", false, false},
+		{"tcp://:2375", false, false},
+		{"tcp://10.0.0.1:2376", false, false},
+		{"0.0.0.0:2375", false, false},
+		{"tcp://0.0.0.0:2376", true, true},
+	} {
+		err := checkProxyBind(test.bind, test.mutualTLS)
+		if (err == nil) != test.ok {
+			t.Errorf("checkProxyBind(%q, %v) = %v", test.bind, test.mutualTLS, err)
+		}
+	}
+}
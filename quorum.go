@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// deadManagers returns the manager nodes the swarm has reported unreachable
+// for longer than managerGracePeriod.
+func (r *Reconcile) deadManagers() []swarm.Node {
+	now := time.Now()
+	var dead []swarm.Node
+	for _, n := range r.nodes {
+		if n.Spec.Role != swarm.NodeRoleManager || n.ManagerStatus == nil {
+			continue
+		}
+		d := r.tracker.observe(n.ID, string(n.ManagerStatus.Reachability), now)
+		if n.ManagerStatus.Reachability != swarm.ReachabilityUnreachable {
+			continue
+		}
+		if d < r.managerGracePeriod {
+			log.WithFields(log.Fields{
+				"id":          n.ID,
+				"unreachable": d,
+			}).Info("Waiting for unreachable manager")
+			continue
+		}
+		dead = append(dead, n)
+	}
+	return dead
+}
+
+// replaceManager replaces the first dead manager, the others follow in later
+// reconciliations. A healthy worker is promoted first if managers are short,
+// then the dead manager is demoted and removed, which only ever improves the
+// ratio of reachable managers. Nothing is planned once quorum is lost, since
+// the swarm can't accept any change.
+func (r *Reconcile) replaceManager(dead []swarm.Node) {
+	reachable, ok := r.quorum()
+	if !ok {
+		return
+	}
+
+	r.plan.Decision = "replace-manager"
+	if reachable < r.managerCount && len(r.workerHosts) > 0 {
+		h := r.pickManager(r.workerHosts)
+		r.plan.add(Step{Action: StepPromote, HostID: h.Id, NodeID: r.hostInfo[h.Id].Swarm.NodeID})
+	}
+
+	n := dead[0]
+	h, _ := r.hostNodes.host(n.ID)
+	r.plan.add(Step{Action: StepDemote, HostID: h.Id, NodeID: n.ID})
+	r.plan.add(Step{Action: StepRemove, HostID: h.Id, NodeID: n.ID, Force: true})
+}
+
+// quorum counts the reachable managers and reports whether they hold a
+// majority, without which the swarm can't accept any change.
+func (r *Reconcile) quorum() (int, bool) {
+	managers, reachable := 0, 0
+	for _, n := range r.nodes {
+		if n.Spec.Role != swarm.NodeRoleManager || n.ManagerStatus == nil {
+			continue
+		}
+		managers++
+		if n.ManagerStatus.Reachability == swarm.ReachabilityReachable {
+			reachable++
+		}
+	}
+	if reachable <= managers/2 {
+		log.WithFields(log.Fields{
+			"managers":  managers,
+			"reachable": reachable,
+		}).Error("Swarm lost quorum, recover it with docker swarm init --force-new-cluster")
+		return reachable, false
+	}
+	return reachable, true
+}
@@ -4,49 +4,138 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math/rand"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/docker/docker/api"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/swarm"
-	"github.com/docker/docker/client"
 	rancher "github.com/rancher/go-rancher/v2"
 )
 
+type reconcileOptions struct {
+	managerCount int
+	dryRun       bool
+
+	// pendingTimeout is how long a host may stay pending before it is
+	// forced to leave the swarm
+	pendingTimeout time.Duration
+	// failureDomainLabel is the host label managers are spread across
+	failureDomainLabel string
+	// selectionPolicy orders the candidates for promotion, demotion in
+	// reverse; selectionLabel is the host label the label policy prefers
+	selectionPolicy []string
+	selectionLabel  string
+	// publishStatus publishes the swarm status of each host in its labels
+	publishStatus bool
+	// pauseLabel is the host label that pauses a node
+	pauseLabel string
+	// host labels with nodeLabelPrefix or listed in nodeLabels are copied
+	// to the host's node
+	nodeLabelPrefix string
+	nodeLabels      []string
+	// drainTimeout is how long a node leaving the swarm may take to drain
+	drainTimeout time.Duration
+	// managerGracePeriod is how long a manager may be unreachable before it
+	// is replaced
+	managerGracePeriod time.Duration
+	// unlockKey unlocks managers of an autolocked swarm
+	unlockKey string
+	// autolock enables autolock and persists the unlock key in the
+	// unlockKeySecret secret, rotating it every unlockKeyRotation
+	autolock          bool
+	unlockKeySecret   string
+	unlockKeyRotation time.Duration
+	secrets           secretStore
+	// joinTokenSecret names the secrets, suffixed -manager and -worker,
+	// that hold the join tokens
+	joinTokenSecret string
+
+	// clusterID pins the expected swarm, otherwise it is read from metadata.
+	// foreignClusterPolicy decides what happens to hosts of other swarms.
+	clusterID            string
+	foreignClusterPolicy string
+	metadata             metadataStore
+	// adoptOnly only adopts the existing swarm, without reconciling it
+	adoptOnly bool
+
+	// maxUnreachable is how many hosts may be unreachable before steps that
+	// demote, remove or reset nodes are held back
+	maxUnreachable int
+
+	// workers bounds how many daemons are called at once. Daemon calls that
+	// read state, that init, join, leave or unlock a swarm, and that update
+	// nodes or the swarm time out after infoTimeout, joinTimeout and
+	// updateTimeout respectively.
+	workers       int
+	infoTimeout   time.Duration
+	joinTimeout   time.Duration
+	updateTimeout time.Duration
+
+	// tracker is shared across reconciliation cycles
+	tracker *hostTracker
+	// fence, if set, is checked before every step and stops act() when it
+	// fails, e.g. once the orchestrator lease is lost
+	fence func() error
+}
+
 type Reconcile struct {
 	sync.Mutex
-	client       *rancher.RancherClient
-	managerCount int
+	reconcileOptions
+	hosts   hostInventory
+	daemons daemonDialer
+	// ctx ends the reconciliation and every daemon call it makes
+	ctx context.Context
 
 	registeredHosts []rancher.Host
 	nodes           []swarm.Node
+	hostNodes       *hostNodeMap
+	runningTasks    map[string]int
 	nodeState       map[swarm.LocalNodeState][]rancher.Host
 	managerHosts    []rancher.Host
 	workerHosts     []rancher.Host
 	managerAddrs    []string
 
-	hostClient  map[string]*client.Client
+	hostClient  map[string]swarmDaemon
 	hostInfo    map[string]types.Info
-	decision    string
+	unreachable map[string]string
+	plan        Plan
 	joinTokens  swarm.JoinTokens
-	removeNodes []swarm.Node
+
+	storedUnlockKey        string
+	storedUnlockKeyCreated time.Time
+	previousUnlockKey      string
+
+	expectedCluster string
+	adopting        bool
 }
 
-func newReconciliation(c *rancher.RancherClient, m int) *Reconcile {
+var errNoManager = errors.New("no reachable manager")
+
+// localNodeStateUnreachable buckets hosts whose daemon couldn't be reached, so
+// their swarm state is unknown.
+const localNodeStateUnreachable swarm.LocalNodeState = "unreachable"
+
+func newReconciliation(i hostInventory, d daemonDialer, o reconcileOptions) *Reconcile {
+	if o.tracker == nil {
+		o.tracker = newHostTracker()
+	}
 	return &Reconcile{
-		client:       c,
-		managerCount: m,
-		nodeState:    make(map[swarm.LocalNodeState][]rancher.Host),
-		hostClient:   make(map[string]*client.Client),
-		hostInfo:     make(map[string]types.Info),
+		reconcileOptions: o,
+		hosts:            i,
+		daemons:          d,
+		ctx:              context.Background(),
+		nodeState:        make(map[swarm.LocalNodeState][]rancher.Host),
+		hostClient:       make(map[string]swarmDaemon),
+		hostInfo:         make(map[string]types.Info),
+		unreachable:      make(map[string]string),
+		runningTasks:     make(map[string]int),
 	}
 }
 
-func (r *Reconcile) run() error {
+func (r *Reconcile) run(ctx context.Context) error {
+	r.ctx = ctx
 	defer r.cleanup()
 
 	if err := r.observe(); err != nil {
@@ -57,6 +146,17 @@ func (r *Reconcile) run() error {
 		return err
 	}
 
+	if len(r.plan.Steps) > 0 {
+		log.WithFields(log.Fields{
+			"plan":    r.plan.String(),
+			"dry-run": r.dryRun,
+		}).Info("Planned reconciliation")
+	}
+
+	if r.dryRun {
+		return nil
+	}
+
 	if err := r.act(); err != nil {
 		return err
 	}
@@ -72,78 +172,223 @@ func (r *Reconcile) observe() error {
 	if err := r.getDaemonInfo(); err != nil {
 		return err
 	}
+	// hosts may have been skipped, their state is unknown
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := r.resolveCluster(); err != nil {
+		return err
+	}
 
 	if err := r.listNodes(); err != nil {
 		return err
 	}
+	r.hostNodes = newHostNodeMap(r.registeredHosts, r.hostInfo, r.nodes)
+	r.countTasks()
+
+	r.loadUnlockKey()
 
 	return nil
 }
 
 func (r *Reconcile) analyze() error {
-	hosts := len(r.registeredHosts)
-	nodes := len(r.nodes)
+	if r.adoptOnly {
+		switch {
+		case r.expectedCluster == "":
+			return errors.New("No swarm found to import")
+		case !r.adopting:
+			return fmt.Errorf("Swarm %s not found on any host", r.expectedCluster)
+		}
+		r.planAdoption()
+		return nil
+	}
+
+	if len(r.unreachable) > 0 {
+		r.plan.Unreachable = r.unreachable
+	}
+
+	r.remediate()
+	r.planForeignHosts()
+	dead := r.deadManagers()
+	stale := r.staleNodes()
+	// orphans that are only waiting to drain don't hold up the rest
+	removals := r.removeOrphans(r.hostNodes.orphans(r.nodes))
+
 	inactive := len(r.nodeState[swarm.LocalNodeStateInactive])
 	pending := len(r.nodeState[swarm.LocalNodeStatePending])
 	active := len(r.nodeState[swarm.LocalNodeStateActive])
 	error := len(r.nodeState[swarm.LocalNodeStateError])
 	locked := len(r.nodeState[swarm.LocalNodeStateLocked])
+	foreign := len(r.nodeState[localNodeStateForeign])
+	unreachable := len(r.nodeState[localNodeStateUnreachable])
+
+	// unhealthy, foreign and unreachable hosts are remediated above and
+	// otherwise left out
+	unhealthy := pending + error + locked + foreign + unreachable
+	hosts := len(r.registeredHosts) - unhealthy
 
 	managers := len(r.managerHosts)
 	workers := len(r.workerHosts)
 
 	switch {
-	case pending > 0 || error > 0 || locked > 0:
-		// TODO: In general, what should we do when certain daemons aren't reachable,
-		// communicable, or in some other bad state?
-		return errors.New("Unimplemented")
-
-	case nodes > hosts:
-		for _, n := range r.nodes {
-			inHosts := false
-			for _, h := range r.registeredHosts {
-				if n.Status.Addr == h.AgentIpAddress {
-					inHosts = true
-					break
-				}
-			}
-			if !inHosts {
-				r.removeNodes = append(r.removeNodes, n)
-			}
+	case len(stale) > 0:
+		r.removeStaleNodes(stale)
+
+	case len(removals) > 0:
+		r.plan.Decision = "remove-nodes"
+		for _, s := range removals {
+			r.plan.add(s)
 		}
-		r.decision = "remove-nodes"
+
+	case len(dead) > 0:
+		r.replaceManager(dead)
+
+	case inactive == hosts && unhealthy > 0:
+		// unhealthy hosts may still belong to a swarm
+		log.Infof("Not initializing a swarm while %d host(s) are unhealthy", unhealthy)
 
 	case inactive == hosts:
-		r.decision = "new"
+		r.plan.Decision = "new"
+		h := r.pickManager(r.nodeState[swarm.LocalNodeStateInactive])
+		r.plan.add(Step{Action: StepInit, HostID: h.Id, Address: h.AgentIpAddress})
+		r.plan.add(Step{Action: StepCreateNetwork, Network: "rancher"})
 
 	case active == hosts:
 		switch {
 		case managers < r.managerCount && (managers%2 == 0 && workers >= 1 || workers >= 2):
-			r.decision = "promote-worker"
+			r.plan.Decision = "promote-worker"
+			h := r.pickManager(r.workerHosts)
+			r.plan.add(Step{Action: StepPromote, HostID: h.Id, NodeID: r.hostInfo[h.Id].Swarm.NodeID})
 			r.getJoinTokens()
 		case managers == 2 && (managers > r.managerCount || workers == 0):
 			log.Info("Can't demote node: this would result in a loss of quorum.")
 		case managers > r.managerCount || managers%2 == 0 && workers == 0:
-			r.decision = "demote-manager"
+			h, ok := r.pickDemotion(r.managerHosts)
+			if !ok {
+				break
+			}
+			r.plan.Decision = "demote-manager"
+			r.plan.add(Step{Action: StepDemote, HostID: h.Id, NodeID: r.hostInfo[h.Id].Swarm.NodeID})
 			r.getJoinTokens()
+		default:
+			r.rebalanceManagers()
 		}
 
 	default:
 		switch {
 		case managers < r.managerCount && (managers%2 == 0 || inactive >= 2):
-			r.decision = "add-manager"
+			r.plan.Decision = "add-manager"
+			h := r.pickManager(r.nodeState[swarm.LocalNodeStateInactive])
+			r.plan.add(Step{Action: StepJoinManager, HostID: h.Id, Address: h.AgentIpAddress})
 		default:
-			r.decision = "add-workers"
+			r.plan.Decision = "add-workers"
+			for _, h := range r.nodeState[swarm.LocalNodeStateInactive] {
+				r.plan.add(Step{Action: StepJoinWorker, HostID: h.Id, Address: h.AgentIpAddress})
+			}
 		}
 		r.getJoinTokens()
 	}
 
+	r.planAvailability()
+
+	if unreachable > r.maxUnreachable {
+		r.holdDestructiveSteps(unreachable)
+	}
+
+	if r.plan.Decision == "" && len(r.plan.Steps) > 0 {
+		r.plan.Decision = "remediate"
+	}
+
+	r.planAdoption()
+	r.planNodeLabels()
+	r.planAutolock()
+	r.planHostStatus()
+
 	return nil
 }
 
+// remediate plans steps for hosts in a pending, error or locked state. A host
+// that is stuck pending is forced to leave once pendingTimeout elapses, a host
+// in error leaves so that it can rejoin, and a locked manager is unlocked if the
+// key is known.
+func (r *Reconcile) remediate() {
+	now := time.Now()
+	ids := make(map[string]bool)
+	for _, n := range r.nodes {
+		ids[n.ID] = true
+		ids[drainKey(n.ID)] = true
+	}
+	for _, h := range r.registeredHosts {
+		ids[h.Id] = true
+		if info, ok := r.hostInfo[h.Id]; ok {
+			r.tracker.observe(h.Id, string(info.Swarm.LocalNodeState), now)
+		} else if _, ok := r.unreachable[h.Id]; ok {
+			r.tracker.observe(h.Id, string(localNodeStateUnreachable), now)
+		}
+	}
+	r.tracker.prune(ids)
+
+	for _, h := range r.nodeState[swarm.LocalNodeStatePending] {
+		d := r.tracker.observe(h.Id, string(swarm.LocalNodeStatePending), now)
+		if d < r.pendingTimeout {
+			log.WithFields(log.Fields{
+				"id":      h.Id,
+				"pending": d,
+			}).Info("Waiting for pending host")
+			continue
+		}
+		r.plan.add(Step{Action: StepLeave, HostID: h.Id, Address: h.AgentIpAddress, Force: true})
+	}
+
+	for _, h := range r.nodeState[swarm.LocalNodeStateError] {
+		log.WithFields(log.Fields{
+			"id":    h.Id,
+			"error": r.hostInfo[h.Id].Swarm.Error,
+		}).Warn("Host is in an error state")
+		r.plan.add(Step{Action: StepLeave, HostID: h.Id, Address: h.AgentIpAddress, Force: true})
+	}
+
+	for _, h := range r.nodeState[swarm.LocalNodeStateLocked] {
+		if r.currentUnlockKey() == "" {
+			log.WithField("id", h.Id).Warn("Manager is locked and no unlock key is known")
+			continue
+		}
+		r.plan.add(Step{Action: StepUnlock, HostID: h.Id, Address: h.AgentIpAddress})
+	}
+}
+
+// holdDestructiveSteps drops the steps that demote, remove or reset nodes:
+// with too many hosts unreachable the observed swarm can't be trusted.
+func (r *Reconcile) holdDestructiveSteps(unreachable int) {
+	var steps []Step
+	for _, s := range r.plan.Steps {
+		if s.Action.destructive() {
+			log.WithFields(log.Fields{
+				"step":        s.String(),
+				"unreachable": unreachable,
+			}).Warn("Holding step while hosts are unreachable")
+			continue
+		}
+		steps = append(steps, s)
+	}
+	r.plan.Steps = steps
+
+	// only remediation left, the fallback below names the decision
+	for _, s := range steps {
+		if !s.Action.remediation() {
+			return
+		}
+	}
+	r.plan.Decision = ""
+}
+
 func (r *Reconcile) getJoinTokens() {
 	for _, h := range r.managerHosts {
-		if s, err := r.hostClient[h.Id].SwarmInspect(context.Background()); err == nil {
+		ctx, cancel := r.callContext(r.infoTimeout)
+		s, err := r.hostClient[h.Id].SwarmInspect(ctx)
+		cancel()
+		if err == nil {
 			r.joinTokens = s.JoinTokens
 
 			for _, m := range r.hostInfo[h.Id].Swarm.RemoteManagers {
@@ -155,27 +400,92 @@ func (r *Reconcile) getJoinTokens() {
 }
 
 func (r *Reconcile) act() error {
-	rand.Seed(time.Now().UnixNano())
+	steps := r.plan.Steps
+	for len(steps) > 0 {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+		if r.fence != nil {
+			if err := r.fence(); err != nil {
+				return err
+			}
+		}
+
+		// consecutive worker joins are independent of each other
+		if steps[0].Action == StepJoinWorker {
+			n := 1
+			for n < len(steps) && steps[n].Action == StepJoinWorker {
+				n++
+			}
+			r.joinWorkers(steps[:n])
+			steps = steps[n:]
+			continue
+		}
+
+		s := steps[0]
+		steps = steps[1:]
+		if err := r.execute(s); err != nil {
+			log.WithFields(log.Fields{
+				"decision": r.plan.Decision,
+				"step":     s.String(),
+				"error":    err.Error(),
+			}).Warn("Failed to execute step")
+			// a host that can't be remediated shouldn't block the others
+			if s.Action.remediation() {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
 
-	switch r.decision {
-	case "new":
-		i := r.nodeState[swarm.LocalNodeStateInactive]
-		h := i[rand.Int31n(int32(len(i)))]
+func (r *Reconcile) joinWorkers(steps []Step) {
+	hosts := make([]rancher.Host, len(steps))
+	for i, s := range steps {
+		hosts[i] = r.host(s.HostID)
+	}
+	r.forEachHost(hosts, func(h rancher.Host) {
+		if err := r.joinHost(h, r.joinTokens.Worker); err != nil {
+			log.WithFields(log.Fields{
+				"decision": r.plan.Decision,
+				"id":       h.Id,
+				"error":    err.Error(),
+			}).Warn("Failed to add worker")
+			return
+		}
+		log.WithFields(log.Fields{
+			"decision": r.plan.Decision,
+			"id":       h.Id,
+		}).Info("Added worker")
+	})
+}
 
+func (r *Reconcile) execute(s Step) error {
+	switch s.Action {
+	case StepInit:
+		h := r.host(s.HostID)
 		req := swarm.InitRequest{
-			AdvertiseAddr: h.AgentIpAddress,
-			ListenAddr:    "0.0.0.0:2377",
+			AdvertiseAddr:    s.Address,
+			ListenAddr:       "0.0.0.0:2377",
+			AutoLockManagers: r.autolock,
 		}
 
-		if _, err := r.hostClient[h.Id].SwarmInit(context.Background(), req); err != nil {
+		ctx, cancel := r.callContext(r.joinTimeout)
+		_, err := r.hostClient[h.Id].SwarmInit(ctx, req)
+		cancel()
+		if err != nil {
 			return err
 		}
 		r.addLabel(h)
 		log.Info("New cluster manager")
 		r.managerHosts = append(r.managerHosts, h)
-		fallthrough
+		if err := r.recordCluster(r.hostClient[h.Id]); err != nil {
+			log.WithField("error", err.Error()).Warn("Failed to record cluster")
+		}
 
-	case "create-network":
+	case StepCreateNetwork:
 		opts := types.NetworkCreate{
 			CheckDuplicate: true,
 			Driver:         "overlay",
@@ -188,14 +498,16 @@ func (r *Reconcile) act() error {
 			Ingress:    false,
 		}
 
-		name := "rancher"
 		for _, h := range r.managerHosts {
-			if resp, err := r.hostClient[h.Id].NetworkCreate(context.Background(), name, opts); err != nil {
+			ctx, cancel := r.callContext(r.updateTimeout)
+			resp, err := r.hostClient[h.Id].NetworkCreate(ctx, s.Network, opts)
+			cancel()
+			if err != nil {
 				log.Warn(err)
 			} else {
 				f := log.Fields{
 					"id":   resp.ID,
-					"name": name,
+					"name": s.Network,
 				}
 				if resp.Warning != "" {
 					f["warning"] = resp.Warning
@@ -205,85 +517,202 @@ func (r *Reconcile) act() error {
 			}
 		}
 
-	case "add-manager":
-		// TODO move the selection logic to analyze()
-		i := r.nodeState[swarm.LocalNodeStateInactive]
-		h := i[rand.Int31n(int32(len(i)))]
-		r.joinHost(h, r.joinTokens.Manager)
+	case StepJoinManager:
+		h := r.host(s.HostID)
+		if err := r.joinHost(h, r.joinTokens.Manager); err != nil {
+			return err
+		}
 		r.addLabel(h)
 		log.WithFields(log.Fields{
-			"decision": r.decision,
+			"decision": r.plan.Decision,
+			"id":       h.Id,
 		}).Info("Added manager")
 
-	case "add-workers":
-		var wg sync.WaitGroup
-		for _, h := range r.nodeState[swarm.LocalNodeStateInactive] {
-			wg.Add(1)
-
-			go func(h rancher.Host) {
-				defer wg.Done()
-				if err := r.joinHost(h, r.joinTokens.Worker); err != nil {
-					log.WithFields(log.Fields{
-						"decision": r.decision,
-						"error":    err.Error(),
-					}).Warn("Failed to add worker")
-				}
-				log.WithFields(log.Fields{
-					"decision": r.decision,
-				}).Info("Added worker")
-			}(h)
+	case StepJoinWorker:
+		r.joinWorkers([]Step{s})
+
+	case StepPromote:
+		if err := r.updateNodeRole(s.NodeID, swarm.NodeRoleManager); err != nil {
+			return err
 		}
-		wg.Wait()
+		r.addLabel(r.host(s.HostID))
+		log.WithFields(log.Fields{
+			"decision": r.plan.Decision,
+			"id":       s.HostID,
+		}).Info("Promoted node")
 
-	case "promote-worker":
-		h := r.workerHosts[rand.Int31n(int32(len(r.workerHosts)))]
-		if err := r.promoteHost(h); err != nil {
-			log.WithField("error", err.Error()).Warn("Failed to promote worker")
+	case StepDemote:
+		if err := r.updateNodeRole(s.NodeID, swarm.NodeRoleWorker); err != nil {
+			return err
+		}
+		if s.HostID != "" {
+			r.deleteLabel(r.host(s.HostID))
+		}
+		log.WithFields(log.Fields{
+			"decision": r.plan.Decision,
+			"id":       s.NodeID,
+		}).Info("Demoted node")
+
+	case StepSetAvailability:
+		err := r.updateNode(s.NodeID, func(spec *swarm.NodeSpec) {
+			spec.Availability = s.Availability
+			s.applyLabels(spec)
+		})
+		if err != nil {
 			return err
 		}
-		r.addLabel(h)
 		log.WithFields(log.Fields{
-			"decision": r.decision,
+			"decision":     r.plan.Decision,
+			"id":           s.NodeID,
+			"availability": s.Availability,
+		}).Info("Updated node availability")
+
+	case StepDrain:
+		err := r.updateNode(s.NodeID, func(spec *swarm.NodeSpec) {
+			spec.Availability = swarm.NodeAvailabilityDrain
+		})
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"decision": r.plan.Decision,
+			"id":       s.NodeID,
+		}).Info("Draining node")
+
+	case StepRemove:
+		if err := r.removeNode(s.NodeID, s.Force); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"decision": r.plan.Decision,
+			"id":       s.NodeID,
+		}).Info("Removed node")
+
+	case StepLeave:
+		h := r.host(s.HostID)
+		ctx, cancel := r.callContext(r.joinTimeout)
+		err := r.hostClient[h.Id].SwarmLeave(ctx, s.Force)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if _, ok := h.Labels["manager"]; ok {
+			r.deleteLabel(h)
+		}
+		log.WithFields(log.Fields{
+			"decision": r.plan.Decision,
 			"id":       h.Id,
-		}).Info("Promoted node")
+		}).Info("Host left swarm")
 
-	case "demote-manager":
-		h := r.managerHosts[rand.Int31n(int32(len(r.managerHosts)))]
-		if err := r.demoteHost(h); err != nil {
-			log.WithField("error", err.Error()).Warn("Failed to demote manager")
+	case StepUnlock:
+		if err := r.unlock(s.HostID); err != nil {
 			return err
 		}
-		r.deleteLabel(h)
 		log.WithFields(log.Fields{
-			"decision": r.decision,
+			"decision": r.plan.Decision,
+			"id":       s.HostID,
+		}).Info("Unlocked manager")
+
+	case StepPinCluster:
+		if err := r.pinClusterID(s.ClusterID); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"decision": r.plan.Decision,
+			"cluster":  s.ClusterID,
+		}).Info("Pinned cluster ID")
+
+	case StepRecordJoinTokens:
+		if err := r.recordJoinTokens(); err != nil {
+			return err
+		}
+		log.WithField("decision", r.plan.Decision).Info("Recorded join tokens")
+
+	case StepLabelManager:
+		r.addLabel(r.host(s.HostID))
+		log.WithFields(log.Fields{
+			"decision": r.plan.Decision,
+			"id":       s.HostID,
+		}).Info("Labeled manager")
+
+	case StepLabelNode:
+		err := r.updateNode(s.NodeID, s.applyLabels)
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"decision": r.plan.Decision,
+			"id":       s.NodeID,
+		}).Info("Labeled node")
+
+	case StepHostStatus:
+		h := r.host(s.HostID)
+		if h.Labels == nil {
+			h.Labels = make(map[string]interface{})
+		}
+		for k, v := range s.Labels {
+			h.Labels[k] = v
+		}
+		for _, k := range s.RemoveLabels {
+			delete(h.Labels, k)
+		}
+		if err := r.hosts.updateHost(h); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"decision": r.plan.Decision,
 			"id":       h.Id,
-		}).Info("Demoted node")
+		}).Debug("Published host status")
 
-	case "remove-nodes":
-		// Demote managers
-		for _, n := range r.removeNodes {
-			if n.Spec.Role == swarm.NodeRoleManager {
-				r.demoteNode(n.ID)
-				log.WithFields(log.Fields{
-					"id":       n.ID,
-					"decision": r.decision,
-				}).Info("Demoted node")
-			}
+	case StepEnableAutolock:
+		if err := r.enableAutolock(); err != nil {
+			return err
 		}
-		// Remove nodes
-		for _, n := range r.removeNodes {
-			r.removeNode(n.ID, true)
-			log.WithFields(log.Fields{
-				"id":       n.ID,
-				"decision": r.decision,
-			}).Info("Removed node")
+		log.WithField("decision", r.plan.Decision).Info("Enabled autolock")
+
+	case StepStoreUnlockKey:
+		if err := r.storeUnlockKey(); err != nil {
+			return err
+		}
+		log.WithField("decision", r.plan.Decision).Info("Stored unlock key")
+
+	case StepRotateUnlockKey:
+		if err := r.rotateUnlockKey(); err != nil {
+			return err
 		}
+		log.WithField("decision", r.plan.Decision).Info("Rotated unlock key")
+
+	default:
+		return fmt.Errorf("unknown step action: %s", s.Action)
 	}
 
 	return nil
 }
 
+// managerClient returns a client for any manager, or nil if there is none.
+func (r *Reconcile) managerClient() swarmDaemon {
+	for _, h := range r.managerHosts {
+		if c, ok := r.hostClient[h.Id]; ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// host returns the registered host with the given ID.
+func (r *Reconcile) host(id string) rancher.Host {
+	for _, h := range r.registeredHosts {
+		if h.Id == id {
+			return h
+		}
+	}
+	return rancher.Host{Resource: rancher.Resource{Id: id}}
+}
+
 func (r *Reconcile) addLabel(h rancher.Host) {
+	if h.Labels == nil {
+		h.Labels = make(map[string]interface{})
+	}
 	h.Labels["manager"] = ""
 	r.updateHost(h)
 }
@@ -294,7 +723,7 @@ func (r *Reconcile) deleteLabel(h rancher.Host) {
 }
 
 func (r *Reconcile) updateHost(h rancher.Host) {
-	if _, err := r.client.Host.Update(&h, h); err != nil {
+	if err := r.hosts.updateHost(h); err != nil {
 		log.Warn(err)
 	}
 }
@@ -313,19 +742,9 @@ func (r *Reconcile) joinHost(h rancher.Host, t string) error {
 		JoinToken:     t,
 		RemoteAddrs:   r.managerAddrs,
 	}
-	return r.hostClient[h.Id].SwarmJoin(context.Background(), req)
-}
-
-func (r *Reconcile) promoteHost(h rancher.Host) error {
-	return r.updateHostRole(h, swarm.NodeRoleManager)
-}
-
-func (r *Reconcile) demoteHost(h rancher.Host) error {
-	return r.updateHostRole(h, swarm.NodeRoleWorker)
-}
-
-func (r *Reconcile) demoteNode(id string) error {
-	return r.updateNodeRole(id, swarm.NodeRoleWorker)
+	ctx, cancel := r.callContext(r.joinTimeout)
+	defer cancel()
+	return r.hostClient[h.Id].SwarmJoin(ctx, req)
 }
 
 func (r *Reconcile) removeNode(id string, force bool) error {
@@ -334,7 +753,10 @@ func (r *Reconcile) removeNode(id string, force bool) error {
 		Force: force,
 	}
 	for _, m := range r.managerHosts {
-		if err = r.hostClient[m.Id].NodeRemove(context.Background(), id, opts); err == nil {
+		ctx, cancel := r.callContext(r.updateTimeout)
+		err = r.hostClient[m.Id].NodeRemove(ctx, id, opts)
+		cancel()
+		if err == nil {
 			break
 		} else {
 			log.Warn(err)
@@ -343,11 +765,13 @@ func (r *Reconcile) removeNode(id string, force bool) error {
 	return err
 }
 
-func (r *Reconcile) updateHostRole(h rancher.Host, role swarm.NodeRole) error {
-	return r.updateNodeRole(r.hostInfo[h.Id].Swarm.NodeID, role)
+func (r *Reconcile) updateNodeRole(id string, role swarm.NodeRole) error {
+	return r.updateNode(id, func(spec *swarm.NodeSpec) {
+		spec.Role = role
+	})
 }
 
-func (r *Reconcile) updateNodeRole(id string, role swarm.NodeRole) error {
+func (r *Reconcile) updateNode(id string, update func(*swarm.NodeSpec)) error {
 	var wn swarm.Node
 	var err error
 	for _, m := range r.managerHosts {
@@ -356,11 +780,14 @@ func (r *Reconcile) updateNodeRole(id string, role swarm.NodeRole) error {
 			continue
 		}
 
-		if wn, _, err = r.hostClient[m.Id].NodeInspectWithRaw(context.Background(), id); err == nil {
-			wn.Spec.Role = role
-			err = r.hostClient[m.Id].NodeUpdate(context.Background(), id, wn.Version, wn.Spec)
+		ctx, cancel := r.callContext(r.updateTimeout)
+		if wn, _, err = r.hostClient[m.Id].NodeInspectWithRaw(ctx, id); err == nil {
+			update(&wn.Spec)
+			err = r.hostClient[m.Id].NodeUpdate(ctx, id, wn.Version, wn.Spec)
+			cancel()
 			break
 		} else {
+			cancel()
 			log.Warn(err)
 		}
 	}
@@ -368,80 +795,87 @@ func (r *Reconcile) updateNodeRole(id string, role swarm.NodeRole) error {
 }
 
 func (r *Reconcile) findHosts() error {
-	h, err := r.client.Host.List(nil)
+	h, err := r.hosts.listHosts()
 	if err != nil {
 		return err
 	}
-	if len(h.Data) == 0 {
+	if len(h) == 0 {
 		return errors.New("No hosts found!")
 	}
-	r.registeredHosts = h.Data
+	r.registeredHosts = h
+
+	// close connections kept for hosts that were removed
+	if c, ok := r.daemons.(daemonCache); ok {
+		c.retain(h)
+	}
 	return nil
 }
 
 func (r *Reconcile) getDaemonInfo() error {
-	clusterID := ""
-	var wg sync.WaitGroup
-	for _, h := range r.registeredHosts {
-		wg.Add(1)
-
-		go func(h rancher.Host) {
-			defer wg.Done()
-			address := fmt.Sprintf("tcp://%s:%d", h.AgentIpAddress, 2375)
-
-			cli, err := client.NewClient(address, api.DefaultVersion, nil, nil)
-			if err != nil {
-				log.Warn(err)
-				return
-			}
-			cli.NegotiateAPIVersion(context.Background())
+	r.forEachHost(r.registeredHosts, func(h rancher.Host) {
+		ctx, cancel := r.callContext(r.infoTimeout)
+		defer cancel()
+
+		cli, err := r.daemons.connect(ctx, h)
+		if err != nil {
+			r.markUnreachable(h, err)
+			return
+		}
 
-			info, err := cli.Info(context.Background())
-			if err != nil {
-				log.Warn(err)
-				return
+		info, err := cli.Info(ctx)
+		if err != nil {
+			cli.Close()
+			// a canceled call says nothing about the connection
+			if c, ok := r.daemons.(daemonCache); ok && r.ctx.Err() == nil {
+				c.evict(h.Id)
 			}
+			r.markUnreachable(h, err)
+			return
+		}
 
-			r.Lock()
-			defer r.Unlock()
-
-			// store docker client and info
-			r.hostClient[h.Id] = cli
-			r.hostInfo[h.Id] = info
-
-			// build a map of hosts keyed by node state
-			r.nodeState[info.Swarm.LocalNodeState] = append(r.nodeState[info.Swarm.LocalNodeState], h)
+		r.Lock()
+		defer r.Unlock()
 
-			// record active managers/workers
-			if info.Swarm.LocalNodeState == swarm.LocalNodeStateActive {
-				if info.Swarm.ControlAvailable {
-					r.managerHosts = append(r.managerHosts, h)
-				} else {
-					r.workerHosts = append(r.workerHosts, h)
-				}
-			}
+		// store docker client and info
+		r.hostClient[h.Id] = cli
+		r.hostInfo[h.Id] = info
 
-			// try to detect cluster ID
-			if info.Swarm.Cluster != nil && info.Swarm.Cluster.ID != "" {
-				if clusterID == "" {
-					clusterID = info.Swarm.Cluster.ID
+		// build a map of hosts keyed by node state
+		r.nodeState[info.Swarm.LocalNodeState] = append(r.nodeState[info.Swarm.LocalNodeState], h)
 
-					// Hard stop if multiple cluster IDs are identified
-				} else if clusterID != info.Swarm.Cluster.ID {
-					log.Fatal(fmt.Sprintf("Multiple cluster IDs detected (%s, %s). Split-brain scenario must be manually resolved.", clusterID, info.Swarm.Cluster.ID))
-				}
+		// record active managers/workers
+		if info.Swarm.LocalNodeState == swarm.LocalNodeStateActive {
+			if info.Swarm.ControlAvailable {
+				r.managerHosts = append(r.managerHosts, h)
+			} else {
+				r.workerHosts = append(r.workerHosts, h)
 			}
-		}(h)
-	}
-	wg.Wait()
+		}
+	})
 
 	return nil
 }
 
+func (r *Reconcile) markUnreachable(h rancher.Host, err error) {
+	log.WithFields(log.Fields{
+		"id":     h.Id,
+		"host":   h.Hostname,
+		"reason": err.Error(),
+	}).Warn("Host is unreachable")
+
+	r.Lock()
+	defer r.Unlock()
+	r.unreachable[h.Id] = err.Error()
+	r.nodeState[localNodeStateUnreachable] = append(r.nodeState[localNodeStateUnreachable], h)
+}
+
 func (r *Reconcile) listNodes() error {
 	var err error
 	for _, m := range r.managerHosts {
-		if r.nodes, err = r.hostClient[m.Id].NodeList(context.Background(), types.NodeListOptions{}); err == nil {
+		ctx, cancel := r.callContext(r.infoTimeout)
+		r.nodes, err = r.hostClient[m.Id].NodeList(ctx, types.NodeListOptions{})
+		cancel()
+		if err == nil {
 			break
 		} else {
 			log.Warn(errors.New(fmt.Sprintf("failed to list nodes: %v", err)))
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func newTestCluster(hosts []string, orphans []swarm.NodeRole) *fakeCluster {
+	c := newFakeCluster()
+	for _, s := range hosts {
+		c.addHost(s)
+	}
+	for _, role := range orphans {
+		c.addOrphan(role)
+	}
+	return c
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		name         string
+		hosts        []string
+		orphans      []swarm.NodeRole
+		managerCount int
+		pending      time.Duration
+		grace        time.Duration
+		unlockKey    string
+		unreachable  int
+		decision     string
+		steps        map[StepAction]int
+		wantErr      bool
+	}{
+		{
+			name:         "pending host within timeout",
+			hosts:        []string{"manager", "pending"},
+			managerCount: 3,
+			pending:      time.Hour,
+			decision:     "",
+		},
+		{
+			name:         "pending host past timeout",
+			hosts:        []string{"manager", "pending"},
+			managerCount: 3,
+			decision:     "remediate",
+			steps:        map[StepAction]int{StepLeave: 1},
+		},
+		{
+			name:         "error host",
+			hosts:        []string{"manager", "error"},
+			managerCount: 3,
+			decision:     "remediate",
+			steps:        map[StepAction]int{StepLeave: 1},
+		},
+		{
+			name:         "locked host without unlock key",
+			hosts:        []string{"manager", "locked"},
+			managerCount: 3,
+			decision:     "",
+		},
+		{
+			name:         "locked host with unlock key",
+			hosts:        []string{"manager", "locked"},
+			managerCount: 3,
+			unlockKey:    fakeUnlockKey,
+			decision:     "remediate",
+			steps:        map[StepAction]int{StepUnlock: 1},
+		},
+		{
+			name:         "healthy hosts reconciled alongside unhealthy",
+			hosts:        []string{"manager", "inactive", "error"},
+			managerCount: 3,
+			decision:     "add-workers",
+			steps:        map[StepAction]int{StepJoinWorker: 1, StepLeave: 1},
+		},
+		{
+			name:         "no init while hosts are unhealthy",
+			hosts:        []string{"inactive", "inactive", "locked"},
+			managerCount: 3,
+			decision:     "",
+		},
+		{
+			name:         "no init while hosts are unreachable",
+			hosts:        []string{"inactive", "inactive", "unreachable"},
+			managerCount: 3,
+			unreachable:  1,
+			decision:     "",
+		},
+		{
+			name:         "unreachable host left out",
+			hosts:        []string{"manager", "worker", "worker", "unreachable"},
+			managerCount: 3,
+			unreachable:  1,
+			decision:     "promote-worker",
+			steps:        map[StepAction]int{StepPromote: 1},
+		},
+		{
+			name:         "hold demotion while too many hosts are unreachable",
+			hosts:        []string{"manager", "manager", "manager", "unreachable", "unreachable"},
+			managerCount: 1,
+			unreachable:  1,
+			decision:     "",
+		},
+		{
+			name:         "demote within unreachable limit",
+			hosts:        []string{"manager", "manager", "manager", "unreachable", "unreachable"},
+			managerCount: 1,
+			unreachable:  2,
+			decision:     "demote-manager",
+			steps:        map[StepAction]int{StepDemote: 1},
+		},
+		{
+			name:         "replace dead manager",
+			hosts:        []string{"manager", "manager", "down-manager", "worker"},
+			managerCount: 3,
+			unreachable:  1,
+			decision:     "replace-manager",
+			steps:        map[StepAction]int{StepPromote: 1, StepDemote: 1, StepRemove: 1},
+		},
+		{
+			name:         "unreachable manager within grace period",
+			hosts:        []string{"manager", "manager", "down-manager", "worker"},
+			managerCount: 3,
+			grace:        time.Hour,
+			unreachable:  1,
+			decision:     "promote-worker",
+			steps:        map[StepAction]int{StepPromote: 1, StepDemote: 0, StepRemove: 0},
+		},
+		{
+			name:         "remove dead manager without a replacement",
+			hosts:        []string{"manager", "manager", "manager", "down-manager"},
+			managerCount: 3,
+			unreachable:  1,
+			decision:     "replace-manager",
+			steps:        map[StepAction]int{StepPromote: 0, StepDemote: 1, StepRemove: 1},
+		},
+		{
+			name:         "no changes without quorum",
+			hosts:        []string{"manager", "down-manager", "down-manager", "worker"},
+			managerCount: 3,
+			unreachable:  2,
+			decision:     "",
+		},
+		{
+			name:         "orphaned node",
+			hosts:        []string{"manager", "worker"},
+			orphans:      []swarm.NodeRole{swarm.NodeRoleWorker},
+			managerCount: 3,
+			decision:     "remove-nodes",
+			steps:        map[StepAction]int{StepDrain: 1, StepDemote: 0, StepRemove: 0},
+		},
+		{
+			name:         "all inactive",
+			hosts:        []string{"inactive", "inactive", "inactive"},
+			managerCount: 3,
+			decision:     "new",
+			steps:        map[StepAction]int{StepInit: 1, StepCreateNetwork: 1},
+		},
+		{
+			name:         "promote with odd managers",
+			hosts:        []string{"manager", "worker", "worker"},
+			managerCount: 3,
+			decision:     "promote-worker",
+			steps:        map[StepAction]int{StepPromote: 1},
+		},
+		{
+			name:         "promote with even managers",
+			hosts:        []string{"manager", "manager", "worker"},
+			managerCount: 3,
+			decision:     "promote-worker",
+			steps:        map[StepAction]int{StepPromote: 1},
+		},
+		{
+			name:         "hold demotion to keep quorum",
+			hosts:        []string{"manager", "manager"},
+			managerCount: 3,
+			decision:     "",
+		},
+		{
+			name:         "demote excess managers",
+			hosts:        []string{"manager", "manager", "manager"},
+			managerCount: 1,
+			decision:     "demote-manager",
+			steps:        map[StepAction]int{StepDemote: 1},
+		},
+		{
+			name:         "demote to odd managers",
+			hosts:        []string{"manager", "manager", "manager", "manager"},
+			managerCount: 5,
+			decision:     "demote-manager",
+			steps:        map[StepAction]int{StepDemote: 1},
+		},
+		{
+			name:         "steady state",
+			hosts:        []string{"manager", "manager", "manager", "worker", "worker"},
+			managerCount: 3,
+			decision:     "",
+		},
+		{
+			name:         "add manager with odd managers",
+			hosts:        []string{"manager", "inactive", "inactive"},
+			managerCount: 3,
+			decision:     "add-manager",
+			steps:        map[StepAction]int{StepJoinManager: 1},
+		},
+		{
+			name:         "add manager with even managers",
+			hosts:        []string{"manager", "manager", "inactive"},
+			managerCount: 3,
+			decision:     "add-manager",
+			steps:        map[StepAction]int{StepJoinManager: 1},
+		},
+		{
+			name:         "add workers when managers are satisfied",
+			hosts:        []string{"manager", "manager", "manager", "inactive"},
+			managerCount: 3,
+			decision:     "add-workers",
+			steps:        map[StepAction]int{StepJoinWorker: 1},
+		},
+		{
+			name:         "add workers when a single manager cannot be paired",
+			hosts:        []string{"manager", "inactive"},
+			managerCount: 3,
+			decision:     "add-workers",
+			steps:        map[StepAction]int{StepJoinWorker: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCluster(tt.hosts, tt.orphans)
+			r := newReconciliation(c, c, reconcileOptions{
+				managerCount:       tt.managerCount,
+				pendingTimeout:     tt.pending,
+				managerGracePeriod: tt.grace,
+				unlockKey:          tt.unlockKey,
+				maxUnreachable:     tt.unreachable,
+			})
+			defer r.cleanup()
+
+			if err := r.observe(); err != nil {
+				t.Fatalf("observe: %v", err)
+			}
+			err := r.analyze()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("analyze: %v", err)
+			}
+			if r.plan.Decision != tt.decision {
+				t.Errorf("decision = %q, want %q", r.plan.Decision, tt.decision)
+			}
+			steps := make(map[StepAction]int)
+			for _, s := range r.plan.Steps {
+				steps[s.Action]++
+			}
+			for action, want := range tt.steps {
+				if steps[action] != want {
+					t.Errorf("%s steps = %d, want %d (plan: %v)", action, steps[action], want, r.plan)
+				}
+			}
+			if len(tt.steps) == 0 && len(r.plan.Steps) > 0 {
+				t.Errorf("unexpected plan: %v", r.plan)
+			}
+			if got, want := len(r.plan.Unreachable), len(r.nodeState[localNodeStateUnreachable]); got != want {
+				t.Errorf("unreachable hosts = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestAct(t *testing.T) {
+	tests := []struct {
+		name         string
+		hosts        []string
+		orphans      []swarm.NodeRole
+		managerCount int
+		unlockKey    string
+		calls        map[string]int
+		managers     int
+	}{
+		{
+			name:         "new",
+			hosts:        []string{"inactive", "inactive", "inactive"},
+			managerCount: 3,
+			calls:        map[string]int{"init": 1, "network rancher": 1, "join": 0},
+			managers:     1,
+		},
+		{
+			name:         "add-manager",
+			hosts:        []string{"manager", "inactive", "inactive"},
+			managerCount: 3,
+			calls:        map[string]int{"join": 1, "join 1h1": 0},
+			managers:     2,
+		},
+		{
+			name:         "add-workers",
+			hosts:        []string{"manager", "manager", "manager", "inactive", "inactive"},
+			managerCount: 3,
+			calls:        map[string]int{"join": 2, "join 1h4 worker": 1, "join 1h5 worker": 1},
+			managers:     3,
+		},
+		{
+			name:         "promote-worker",
+			hosts:        []string{"manager", "worker", "worker"},
+			managerCount: 3,
+			calls:        map[string]int{"update": 1, "update node1": 0},
+			managers:     2,
+		},
+		{
+			name:         "demote-manager",
+			hosts:        []string{"manager", "manager", "manager"},
+			managerCount: 1,
+			calls:        map[string]int{"update": 1},
+			managers:     2,
+		},
+		{
+			name:         "remove-nodes",
+			hosts:        []string{"manager", "worker"},
+			orphans:      []swarm.NodeRole{swarm.NodeRoleManager},
+			managerCount: 3,
+			calls:        map[string]int{"update node3 role=manager availability=drain": 1, "update node3 role=worker": 0, "remove": 0},
+			managers:     1,
+		},
+		{
+			name:         "steady state",
+			hosts:        []string{"manager", "manager", "manager", "worker"},
+			managerCount: 3,
+			calls:        map[string]int{"init": 0, "join": 0, "update": 0, "remove": 0},
+			managers:     3,
+		},
+		{
+			name:         "replace dead manager",
+			hosts:        []string{"manager", "manager", "down-manager", "worker"},
+			managerCount: 3,
+			calls:        map[string]int{"update node4 role=manager": 1, "update node3 role=worker": 1, "remove node3 force=true": 1},
+			managers:     3,
+		},
+		{
+			name:         "leave on error",
+			hosts:        []string{"manager", "manager", "manager", "error"},
+			managerCount: 3,
+			calls:        map[string]int{"leave 1h4 force=true": 1},
+			managers:     3,
+		},
+		{
+			name:         "unlock locked manager",
+			hosts:        []string{"manager", "manager", "locked"},
+			managerCount: 3,
+			unlockKey:    fakeUnlockKey,
+			calls:        map[string]int{"unlock 1h3": 1},
+			managers:     3,
+		},
+		{
+			name:         "failed unlock doesn't block the plan",
+			hosts:        []string{"manager", "locked", "inactive", "inactive"},
+			managerCount: 3,
+			unlockKey:    "wrong",
+			calls:        map[string]int{"unlock": 0, "join": 1},
+			managers:     3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCluster(tt.hosts, tt.orphans)
+			opts := reconcileOptions{
+				managerCount:   tt.managerCount,
+				unlockKey:      tt.unlockKey,
+				maxUnreachable: 1,
+			}
+			if err := newReconciliation(c, c, opts).run(context.Background()); err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			for prefix, want := range tt.calls {
+				if got := c.count(prefix); got != want {
+					t.Errorf("%q calls = %d, want %d (calls: %v)", prefix, got, want, c.calls)
+				}
+			}
+			if got := c.labeled("manager"); got != tt.managers {
+				t.Errorf("manager labels = %d, want %d", got, tt.managers)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	c := newTestCluster([]string{"manager", "worker", "worker", "inactive"}, []swarm.NodeRole{swarm.NodeRoleWorker})
+	r := newReconciliation(c, c, reconcileOptions{managerCount: 3, dryRun: true})
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if len(r.plan.Steps) == 0 {
+		t.Error("expected a plan")
+	}
+	if len(c.calls) > 0 {
+		t.Errorf("dry run made changes: %v", c.calls)
+	}
+}
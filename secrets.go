@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+// secretStore reads and writes named secrets. A missing secret reads as "".
+// getSecret also returns when the secret was last written.
+type secretStore interface {
+	getSecret(name string) (string, time.Time, error)
+	putSecret(name, value string) error
+}
+
+type rancherSecrets struct {
+	client *rancher.RancherClient
+}
+
+func (s *rancherSecrets) list(name string) ([]rancher.Secret, error) {
+	secrets, err := s.client.Secret.List(&rancher.ListOpts{
+		Filters: map[string]interface{}{
+			"name": name,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secrets.Data, nil
+}
+
+// getSecret reads the most recently created secret of that name, as an
+// interrupted putSecret may leave older ones behind.
+func (s *rancherSecrets) getSecret(name string) (string, time.Time, error) {
+	secrets, err := s.list(name)
+	if err != nil || len(secrets) == 0 {
+		return "", time.Time{}, err
+	}
+	var latest rancher.Secret
+	var created time.Time
+	for _, secret := range secrets {
+		t, _ := time.Parse(time.RFC3339, secret.Created)
+		if latest.Id == "" || t.After(created) {
+			latest, created = secret, t
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(latest.Value)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return string(b), created, nil
+}
+
+// putSecret replaces the named secret, since Rancher secret values are
+// immutable. The new secret is created first and the old ones are only
+// deleted once it reads back, so a failure never loses the value.
+func (s *rancherSecrets) putSecret(name, value string) error {
+	old, err := s.list(name)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(value))
+	secret, err := s.client.Secret.Create(&rancher.Secret{
+		Name:  name,
+		Value: encoded,
+	})
+	if err != nil {
+		return err
+	}
+	if stored, err := s.client.Secret.ById(secret.Id); err != nil {
+		return err
+	} else if stored == nil || stored.Value != encoded {
+		return fmt.Errorf("secret %s did not read back", name)
+	}
+	for i := range old {
+		if err := s.client.Secret.Delete(&old[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+// selection policies, applied in the configured order
+const (
+	selectOldest    = "oldest"
+	selectResources = "resources"
+	selectLabel     = "label"
+	selectSpread    = "spread"
+)
+
+// hostOrder compares two hosts: negative if a should become a manager before
+// b, positive if after, zero if the policy can't tell.
+type hostOrder func(a, b rancher.Host) int
+
+func validSelectionPolicy(policy []string) error {
+	for _, p := range policy {
+		switch p {
+		case selectOldest, selectResources, selectLabel, selectSpread:
+		default:
+			return fmt.Errorf("unknown selection policy: %s", p)
+		}
+	}
+	return nil
+}
+
+// orders returns the configured policies followed by the host age and ID,
+// so that no two hosts ever compare equal.
+func (r *Reconcile) orders() []hostOrder {
+	var orders []hostOrder
+	for _, p := range r.selectionPolicy {
+		switch p {
+		case selectOldest:
+			orders = append(orders, r.byAge)
+		case selectResources:
+			orders = append(orders, r.byResources)
+		case selectLabel:
+			orders = append(orders, r.byLabel)
+		case selectSpread:
+			orders = append(orders, r.bySpread)
+		}
+	}
+	return append(orders, r.byAge, byID)
+}
+
+// sortHosts returns a copy of hosts, best manager candidates first.
+func (r *Reconcile) sortHosts(hosts []rancher.Host) []rancher.Host {
+	orders := r.orders()
+	sorted := append([]rancher.Host(nil), hosts...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		for _, order := range orders {
+			if c := order(sorted[i], sorted[j]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return sorted
+}
+
+// pickManager picks the host to turn into a manager, the first by policy.
+func (r *Reconcile) pickManager(hosts []rancher.Host) rancher.Host {
+	return r.sortHosts(hosts)[0]
+}
+
+// pickDemotion picks the manager to demote from the opposite end of the
+// policy. The leader is never demoted.
+func (r *Reconcile) pickDemotion(managers []rancher.Host) (rancher.Host, bool) {
+	sorted := r.sortHosts(managers)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if !r.isLeader(sorted[i]) {
+			return sorted[i], true
+		}
+	}
+	return rancher.Host{}, false
+}
+
+func (r *Reconcile) isLeader(h rancher.Host) bool {
+	n, ok := r.hostNodes.node(h.Id)
+	return ok && n.ManagerStatus != nil && n.ManagerStatus.Leader
+}
+
+// byAge prefers hosts registered earlier, hosts without a creation time last.
+func (r *Reconcile) byAge(a, b rancher.Host) int {
+	ta, errA := time.Parse(time.RFC3339, a.Created)
+	tb, errB := time.Parse(time.RFC3339, b.Created)
+	switch {
+	case errA != nil && errB != nil:
+		return 0
+	case errA != nil:
+		return 1
+	case errB != nil:
+		return -1
+	case ta.Before(tb):
+		return -1
+	case tb.Before(ta):
+		return 1
+	}
+	return 0
+}
+
+// byResources prefers hosts with more CPUs, then more memory.
+func (r *Reconcile) byResources(a, b rancher.Host) int {
+	ia, ib := r.hostInfo[a.Id], r.hostInfo[b.Id]
+	switch {
+	case ia.NCPU != ib.NCPU:
+		return ib.NCPU - ia.NCPU
+	case ia.MemTotal > ib.MemTotal:
+		return -1
+	case ia.MemTotal < ib.MemTotal:
+		return 1
+	}
+	return 0
+}
+
+// byLabel prefers hosts carrying selectionLabel, given as key or key=value.
+func (r *Reconcile) byLabel(a, b rancher.Host) int {
+	has := func(h rancher.Host) bool {
+		kv := strings.SplitN(r.selectionLabel, "=", 2)
+		v, ok := h.Labels[kv[0]]
+		if !ok || len(kv) == 1 {
+			return ok
+		}
+		return fmt.Sprint(v) == kv[1]
+	}
+	switch ha, hb := has(a), has(b); {
+	case ha && !hb:
+		return -1
+	case hb && !ha:
+		return 1
+	}
+	return 0
+}
+
+// bySpread prefers hosts in failure domains with fewer managers.
+func (r *Reconcile) bySpread(a, b rancher.Host) int {
+	if r.failureDomainLabel == "" {
+		return 0
+	}
+	counts := r.managerDomains()
+	return counts[r.domain(a)] - counts[r.domain(b)]
+}
+
+// byID orders hosts by ID, numerically where the IDs share a prefix.
+func byID(a, b rancher.Host) int {
+	switch {
+	case len(a.Id) != len(b.Id):
+		return len(a.Id) - len(b.Id)
+	case a.Id < b.Id:
+		return -1
+	case a.Id > b.Id:
+		return 1
+	}
+	return 0
+}
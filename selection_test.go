@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+func TestSelectionPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  []string
+		label   string
+		leader  string
+		created bool
+		manager string
+		demote  string
+	}{
+		{
+			name:    "host ID breaks ties",
+			manager: "1h2",
+			demote:  "1h10",
+		},
+		{
+			name:    "oldest",
+			policy:  []string{selectOldest},
+			created: true,
+			manager: "1h10",
+			demote:  "1h3",
+		},
+		{
+			name:    "resources",
+			policy:  []string{selectResources},
+			created: true,
+			manager: "1h3",
+			demote:  "1h2",
+		},
+		{
+			name:    "label",
+			policy:  []string{selectLabel, selectOldest},
+			label:   "disk=ssd",
+			created: true,
+			manager: "1h3",
+			demote:  "1h2",
+		},
+		{
+			name:    "leader is never demoted",
+			policy:  []string{selectResources},
+			leader:  "node2",
+			created: true,
+			manager: "1h3",
+			demote:  "1h10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := make([]string, 10)
+			for i := range hosts {
+				hosts[i] = "manager"
+			}
+			c := newTestCluster(hosts, nil)
+			if tt.leader != "" {
+				c.node(tt.leader).ManagerStatus.Leader = true
+			}
+			r := newReconciliation(c, c, reconcileOptions{
+				managerCount:    3,
+				selectionPolicy: tt.policy,
+				selectionLabel:  tt.label,
+			})
+			defer r.cleanup()
+			if err := r.observe(); err != nil {
+				t.Fatalf("observe: %v", err)
+			}
+
+			// candidates: 1h2 is the smallest, 1h3 the largest and labeled,
+			// 1h10 the oldest
+			candidates := []rancher.Host{r.host("1h10"), r.host("1h3"), r.host("1h2")}
+			if tt.created {
+				candidates[0].Created = "2017-01-01T00:00:00Z"
+				candidates[1].Created = "2017-03-01T00:00:00Z"
+				candidates[2].Created = "2017-02-01T00:00:00Z"
+			}
+			candidates[1].Labels["disk"] = "ssd"
+			candidates[2].Labels["disk"] = "hdd"
+			r.hostInfo["1h2"] = types.Info{NCPU: 1}
+			r.hostInfo["1h3"] = types.Info{NCPU: 8}
+			r.hostInfo["1h10"] = types.Info{NCPU: 2}
+
+			if h := r.pickManager(candidates); h.Id != tt.manager {
+				t.Errorf("manager = %s, want %s", h.Id, tt.manager)
+			}
+			if h, _ := r.pickDemotion(candidates); h.Id != tt.demote {
+				t.Errorf("demoted = %s, want %s", h.Id, tt.demote)
+			}
+		})
+	}
+}
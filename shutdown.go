@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var errShuttingDown = errors.New("shutting down")
+
+// shutdown follows the signals that stop the orchestrator. The first one
+// stops scheduling reconciliations and steps, but lets the step in flight
+// finish or time out; a second one cancels that step as well, and a third
+// kills the process.
+type shutdown struct {
+	sync.Mutex
+	// stopping ends with the first signal, aborting with the second
+	stopping context.Context
+	aborting context.Context
+	stop     context.CancelFunc
+	abort    context.CancelFunc
+	aborted  os.Signal
+}
+
+func newShutdown() *shutdown {
+	s := &shutdown{}
+	s.stopping, s.stop = context.WithCancel(context.Background())
+	s.aborting, s.abort = context.WithCancel(context.Background())
+	return s
+}
+
+// handleSignals shuts down on SIGINT and SIGTERM.
+func handleSignals() *shutdown {
+	s := newShutdown()
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go s.watch(c)
+	return s
+}
+
+func (s *shutdown) watch(c chan os.Signal) {
+	sig := <-c
+	log.WithField("signal", sig.String()).Info("Shutting down once the current step is done, signal again to abort it")
+	s.stop()
+
+	sig = <-c
+	log.WithField("signal", sig.String()).Warn("Aborting the current step")
+	s.Lock()
+	s.aborted = sig
+	s.Unlock()
+	s.abort()
+	signal.Stop(c)
+}
+
+// fence fails once the orchestrator is shutting down, which stops act()
+// before its next step.
+func (s *shutdown) fence() error {
+	if s.stopping.Err() != nil {
+		return errShuttingDown
+	}
+	return nil
+}
+
+// err is what the orchestrator exits with: nothing after a graceful shutdown,
+// or the conventional 128+n status if signal n aborted a step.
+func (s *shutdown) err() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.aborted == nil {
+		return nil
+	}
+	code := 1
+	if n, ok := s.aborted.(syscall.Signal); ok {
+		code = 128 + int(n)
+	}
+	return cli.NewExitError(fmt.Sprintf("aborted by %s", s.aborted), code)
+}
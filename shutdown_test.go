@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func TestShutdown(t *testing.T) {
+	s := newShutdown()
+	c := make(chan os.Signal, 2)
+	go s.watch(c)
+
+	c <- syscall.SIGTERM
+	select {
+	case <-s.stopping.Done():
+	case <-time.After(time.Second):
+		t.Fatal("first signal didn't stop the orchestrator")
+	}
+	if s.aborting.Err() != nil {
+		t.Error("first signal aborted the current step")
+	}
+	if err := s.fence(); err != errShuttingDown {
+		t.Errorf("fence = %v, want %v", err, errShuttingDown)
+	}
+	if err := s.err(); err != nil {
+		t.Errorf("graceful shutdown exits with %v", err)
+	}
+
+	c <- syscall.SIGINT
+	select {
+	case <-s.aborting.Done():
+	case <-time.After(time.Second):
+		t.Fatal("second signal didn't abort the current step")
+	}
+	err, ok := s.err().(cli.ExitCoder)
+	if !ok || err.ExitCode() != 130 {
+		t.Errorf("aborted shutdown exits with %v, want status 130", s.err())
+	}
+}
+
+func TestShutdownStopsSteps(t *testing.T) {
+	c := newTestCluster([]string{"manager", "inactive", "inactive"}, nil)
+	s := newShutdown()
+	s.stop()
+
+	err := newReconciliation(c, c, reconcileOptions{managerCount: 3, fence: s.fence}).run(context.Background())
+	if err != errShuttingDown {
+		t.Errorf("run = %v, want %v", err, errShuttingDown)
+	}
+	if got := c.count("join"); got != 0 {
+		t.Errorf("join calls = %d, want 0", got)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// staleNodes returns the down nodes a ready node has taken over, matched by
+// hostname: re-provisioned hosts join as new nodes and leave their old node
+// behind. NodeList doesn't expose engine IDs, and addresses are shared behind
+// NAT, so the hostname is the only identity to compare. A down node that is
+// still known to belong to a registered host, by its node ID or UUID label,
+// is never stale.
+func (r *Reconcile) staleNodes() []swarm.Node {
+	hostnames := make(map[string]bool)
+	for _, n := range r.nodes {
+		if n.Status.State == swarm.NodeStateReady && n.Description.Hostname != "" {
+			hostnames[n.Description.Hostname] = true
+		}
+	}
+
+	var stale []swarm.Node
+	for _, n := range r.nodes {
+		if n.Status.State != swarm.NodeStateDown || !hostnames[n.Description.Hostname] {
+			continue
+		}
+		if r.hostNodes.identified[n.ID] {
+			continue
+		}
+		stale = append(stale, n)
+	}
+	return stale
+}
+
+// removeStaleNodes demotes every stale manager, then removes all the stale
+// nodes. Stale managers are unreachable, so demoting them can't cost quorum,
+// but the swarm must still have it to accept the changes.
+func (r *Reconcile) removeStaleNodes(stale []swarm.Node) {
+	if _, ok := r.quorum(); !ok {
+		return
+	}
+
+	r.plan.Decision = "remove-stale-nodes"
+	for _, n := range stale {
+		if n.Spec.Role == swarm.NodeRoleManager {
+			r.plan.add(Step{Action: StepDemote, NodeID: n.ID})
+		}
+	}
+	for _, n := range stale {
+		r.plan.add(Step{Action: StepRemove, NodeID: n.ID, Force: true})
+	}
+}
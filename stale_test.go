@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func TestStaleNodes(t *testing.T) {
+	tests := []struct {
+		name  string
+		stale func(c *fakeCluster)
+		calls map[string]int
+	}{
+		{
+			// hosts behind NAT share an address, the node is left to
+			// orphan handling
+			name: "duplicate address",
+			stale: func(c *fakeCluster) {
+				c.addStale("10.0.0.4", "old", swarm.NodeRoleWorker)
+			},
+			calls: map[string]int{"remove node5 force=true": 0},
+		},
+		{
+			// an unreachable host still owns its node
+			name: "node of a registered host",
+			stale: func(c *fakeCluster) {
+				h := c.addHost("unreachable")
+				id := c.addStale("10.0.0.4", "host4", swarm.NodeRoleWorker)
+				c.node(id).Spec.Labels = map[string]string{nodeLabelHostUUID: h.Uuid}
+			},
+			calls: map[string]int{"remove": 0},
+		},
+		{
+			name: "duplicate hostname",
+			stale: func(c *fakeCluster) {
+				c.addStale("10.0.1.4", "host4", swarm.NodeRoleWorker)
+			},
+			calls: map[string]int{"remove node5 force=true": 1, "update": 0},
+		},
+		{
+			name: "several duplicates",
+			stale: func(c *fakeCluster) {
+				c.addStale("10.0.0.1", "host1", swarm.NodeRoleManager)
+				c.addStale("10.0.1.4", "host4", swarm.NodeRoleWorker)
+				c.addStale("10.0.2.4", "host4", swarm.NodeRoleWorker)
+			},
+			calls: map[string]int{
+				"update node5 role=worker": 1,
+				"remove node5 force=true":  1,
+				"remove node6 force=true":  1,
+				"remove node7 force=true":  1,
+				"update":                   1,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCluster([]string{"manager", "manager", "manager", "worker"}, nil)
+			tt.stale(c)
+
+			opts := reconcileOptions{managerCount: 3, maxUnreachable: 1}
+			if err := newReconciliation(c, c, opts).run(context.Background()); err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			for prefix, want := range tt.calls {
+				if got := c.count(prefix); got != want {
+					t.Errorf("%q calls = %d, want %d (calls: %v)", prefix, got, want, c.calls)
+				}
+			}
+		})
+	}
+}
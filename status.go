@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/docker/docker/api/types/swarm"
+	rancher "github.com/rancher/go-rancher/v2"
+)
+
+// host labels that publish the observed swarm membership of each host
+const (
+	hostLabelRole      = "swarm.role"
+	hostLabelState     = "swarm.state"
+	hostLabelNodeID    = "swarm.node_id"
+	hostLabelClusterID = "swarm.cluster_id"
+	hostLabelLeader    = "swarm.leader"
+	hostLabelError     = "swarm.error"
+)
+
+var hostStatusLabels = []string{
+	hostLabelRole,
+	hostLabelState,
+	hostLabelNodeID,
+	hostLabelClusterID,
+	hostLabelLeader,
+	hostLabelError,
+}
+
+// hostStatus returns the status labels of a host in the given state. Labels
+// that don't apply are left empty. Nothing is known about the membership of
+// an unreachable host, so it keeps the labels last published for it rather
+// than losing them to a single failed call.
+func (r *Reconcile) hostStatus(h rancher.Host, state swarm.LocalNodeState) map[string]string {
+	status := map[string]string{hostLabelState: string(state)}
+	if state == localNodeStateUnreachable {
+		for _, k := range []string{hostLabelRole, hostLabelNodeID, hostLabelClusterID, hostLabelLeader} {
+			if v, ok := h.Labels[k].(string); ok {
+				status[k] = v
+			}
+		}
+		status[hostLabelError] = r.unreachable[h.Id]
+		return status
+	}
+
+	info := r.hostInfo[h.Id]
+	status[hostLabelNodeID] = info.Swarm.NodeID
+	status[hostLabelClusterID] = infoClusterID(info)
+	status[hostLabelError] = info.Swarm.Error
+	if state == swarm.LocalNodeStateActive || state == swarm.LocalNodeStateLocked {
+		if n, ok := r.hostNodes.node(h.Id); ok {
+			status[hostLabelRole] = string(n.Spec.Role)
+			if n.ManagerStatus != nil && n.ManagerStatus.Leader {
+				status[hostLabelLeader] = "true"
+			}
+		} else if info.Swarm.ControlAvailable {
+			status[hostLabelRole] = string(swarm.NodeRoleManager)
+		} else if state == swarm.LocalNodeStateActive {
+			status[hostLabelRole] = string(swarm.NodeRoleWorker)
+		}
+	}
+	return status
+}
+
+// planHostStatus publishes the status labels of every host whose labels
+// don't match what was observed.
+func (r *Reconcile) planHostStatus() {
+	if !r.publishStatus {
+		return
+	}
+
+	states := make(map[string]swarm.LocalNodeState)
+	for state, hosts := range r.nodeState {
+		for _, h := range hosts {
+			states[h.Id] = state
+		}
+	}
+
+	var steps []Step
+	for _, h := range r.registeredHosts {
+		state, ok := states[h.Id]
+		if !ok {
+			continue
+		}
+		status := r.hostStatus(h, state)
+
+		set := make(map[string]string)
+		var remove []string
+		for _, k := range hostStatusLabels {
+			cur, ok := h.Labels[k]
+			switch v := status[k]; {
+			case v != "" && (!ok || cur != v):
+				set[k] = v
+			case v == "" && ok:
+				remove = append(remove, k)
+			}
+		}
+		if len(set) == 0 && len(remove) == 0 {
+			continue
+		}
+		sort.Strings(remove)
+		step := Step{Action: StepHostStatus, HostID: h.Id, Address: h.AgentIpAddress, RemoveLabels: remove}
+		if len(set) > 0 {
+			step.Labels = set
+		}
+		steps = append(steps, step)
+	}
+
+	if len(steps) == 0 {
+		return
+	}
+	if r.plan.Decision == "" {
+		r.plan.Decision = "publish-status"
+	}
+	for _, step := range steps {
+		r.plan.add(step)
+	}
+}
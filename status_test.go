@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestHostStatus(t *testing.T) {
+	c := newTestCluster([]string{"manager", "manager", "manager", "worker", "unreachable", "foreign"}, nil)
+	c.node("node1").ManagerStatus.Leader = true
+	c.hosts[3].Labels[hostLabelLeader] = "true"
+
+	opts := reconcileOptions{
+		managerCount:         3,
+		foreignClusterPolicy: foreignClusterHold,
+		clusterID:            "cluster-1",
+		publishStatus:        true,
+	}
+	if err := newReconciliation(c, c, opts).run(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	want := []map[string]interface{}{
+		{hostLabelRole: "manager", hostLabelState: "active", hostLabelNodeID: "node1", hostLabelClusterID: "cluster-1", hostLabelLeader: "true"},
+		{hostLabelRole: "manager", hostLabelState: "active", hostLabelNodeID: "node2", hostLabelClusterID: "cluster-1"},
+		{hostLabelRole: "manager", hostLabelState: "active", hostLabelNodeID: "node3", hostLabelClusterID: "cluster-1"},
+		{hostLabelRole: "worker", hostLabelState: "active", hostLabelNodeID: "node4", hostLabelClusterID: "cluster-1"},
+		{hostLabelState: "unreachable", hostLabelError: "no daemon for host 1h5"},
+		{hostLabelState: "foreign", hostLabelNodeID: "foreign-1h6", hostLabelClusterID: "cluster-2"},
+	}
+	for i, h := range c.hosts {
+		for _, k := range hostStatusLabels {
+			got, ok := h.Labels[k]
+			if v, want := want[i][k]; want != ok || ok && got != v {
+				t.Errorf("host %s label %s = %v, want %v", h.Id, k, got, v)
+			}
+		}
+	}
+
+	r := newReconciliation(c, c, opts)
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	for _, s := range r.plan.Steps {
+		if s.Action == StepHostStatus {
+			t.Errorf("status published again: %v", s)
+		}
+	}
+}
+
+func TestHostStatusUnreachable(t *testing.T) {
+	c := newTestCluster([]string{"manager", "manager", "manager"}, nil)
+	c.node("node1").ManagerStatus.Leader = true
+	opts := reconcileOptions{
+		managerCount:  3,
+		clusterID:     "cluster-1",
+		publishStatus: true,
+	}
+	if err := newReconciliation(c, c, opts).run(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	// the leader's daemon stops answering for a cycle
+	d := c.daemons["1h1"]
+	delete(c.daemons, "1h1")
+	r := newReconciliation(c, c, opts)
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := map[string]interface{}{
+		hostLabelRole:      "manager",
+		hostLabelState:     "unreachable",
+		hostLabelNodeID:    "node1",
+		hostLabelClusterID: "cluster-1",
+		hostLabelLeader:    "true",
+		hostLabelError:     "no daemon for host 1h1",
+	}
+	for k, v := range want {
+		if got := c.hosts[0].Labels[k]; got != v {
+			t.Errorf("label %s = %v, want %v", k, got, v)
+		}
+	}
+	for _, s := range r.plan.Steps {
+		if s.Action == StepHostStatus && len(s.RemoveLabels) > 0 {
+			t.Errorf("unreachable host lost labels: %v", s)
+		}
+	}
+
+	// once it answers again, only its state and error change
+	c.daemons["1h1"] = d
+	r = newReconciliation(c, c, opts)
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var steps []Step
+	for _, s := range r.plan.Steps {
+		if s.Action == StepHostStatus && s.HostID == "1h1" {
+			steps = append(steps, s)
+		}
+	}
+	if len(steps) != 1 || len(steps[0].Labels) != 1 || steps[0].Labels[hostLabelState] != "active" ||
+		len(steps[0].RemoveLabels) != 1 || steps[0].RemoveLabels[0] != hostLabelError {
+		t.Errorf("status steps = %v, want the state set and the error removed", steps)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// hostTracker remembers how long each host, or swarm node, has been in its
+// current state. Unlike a Reconcile, it lives across reconciliation cycles.
+type hostTracker struct {
+	sync.Mutex
+	states map[string]trackedState
+}
+
+type trackedState struct {
+	state string
+	since time.Time
+}
+
+func newHostTracker() *hostTracker {
+	return &hostTracker{
+		states: make(map[string]trackedState),
+	}
+}
+
+// observe records the host's current state and returns how long it has been
+// in that state.
+func (t *hostTracker) observe(id, state string, now time.Time) time.Duration {
+	t.Lock()
+	defer t.Unlock()
+
+	s, ok := t.states[id]
+	if !ok || s.state != state {
+		s = trackedState{state: state, since: now}
+		t.states[id] = s
+	}
+	return now.Sub(s.since)
+}
+
+// prune forgets every host or node that is not in ids.
+func (t *hostTracker) prune(ids map[string]bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	for id := range t.states {
+		if !ids[id] {
+			delete(t.states, id)
+		}
+	}
+}